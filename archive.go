@@ -0,0 +1,199 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Formats of generic parts, selected per upload with --archive.
+const (
+	ArchiveNone = "none" // Raw byte parts, joined again with cat
+	ArchiveZip  = "zip"  // Volumes of a store-only zip archive: name.zip.001, name.zip.002, ...
+)
+
+// zipVolumeName returns the name of volume partNum of the zip archive made for fileName.
+// 7-Zip, WinRAR, ZArchiver and Keka open the first volume and read the rest in order.
+func zipVolumeName(fileName string, partNum int) string {
+	return fmt.Sprintf("%s.zip.%03d", strings.TrimSuffix(fileName, filepath.Ext(fileName)), partNum)
+}
+
+// zipInstructions tells the recipients of the zip volumes of fileName how to extract it.
+func zipInstructions(fileName string) string {
+	return fmt.Sprintf("To extract '%s', save all parts in one folder and open '%s' with 7-Zip, WinRAR, ZArchiver or Keka.",
+		fileName, zipVolumeName(fileName, 1))
+}
+
+// splitGeneric splits a file that is not split as media into the part format selected by opts.Archive.
+// If onPart is non-nil it is called as each part is created.
+func (s *partSender) splitGeneric(ctx context.Context, filePath string, onPart partCallback) ([]splitPart, error) {
+	if s.opts.Archive == ArchiveZip {
+		log.Printf("Packing '%s' into zip volumes...", s.name)
+		return splitZipVolumes(ctx, filePath, s.name, PartSize, s.events, onPart)
+	}
+	return splitGenericFile(ctx, filePath, PartSize, s.events, onPart)
+}
+
+// splitZipVolumes packs sourcePath into a zip archive without compression, holding a
+// single entry named entryName, and writes the archive as volumes of partSize bytes
+// next to the source. The archive is the same for the same source, so volumes
+// written again by a resumed upload match the ones sent before.
+// If onPart is non-nil it is called as each volume is completed.
+func splitZipVolumes(ctx context.Context, sourcePath, entryName string, partSize int64, events *eventStream, onPart partCallback) ([]splitPart, error) {
+	if partSize <= 0 {
+		return nil, fmt.Errorf("part size must be positive")
+	}
+	sourceFile, err := os.Open(sourcePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open source file %s: %w", sourcePath, err)
+	}
+	defer sourceFile.Close()
+	sourceInfo, err := sourceFile.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file info for %s: %w", sourcePath, err)
+	}
+	events.emit(EventSplitStarted, event{File: sourceInfo.Name(), Strategy: StrategyArchive, Total: sourceInfo.Size()})
+
+	volumes := &volumeWriter{
+		ctx:    ctx,
+		dir:    filepath.Dir(sourcePath),
+		name:   sourceInfo.Name(),
+		size:   partSize,
+		events: events,
+		onPart: onPart,
+	}
+	fail := func(err error) ([]splitPart, error) {
+		volumes.abort()
+		return nil, err
+	}
+
+	zw := zip.NewWriter(volumes)
+	entry, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     entryName,
+		Method:   zip.Store, // Already compressed media and archives gain nothing from deflate
+		Modified: sourceInfo.ModTime(),
+	})
+	if err != nil {
+		return fail(fmt.Errorf("failed to start zip archive: %w", err))
+	}
+	buffer := make([]byte, 1*1024*1024) // 1MB buffer
+	for {
+		if err := ctx.Err(); err != nil {
+			return fail(err)
+		}
+		n, readErr := sourceFile.Read(buffer)
+		if n > 0 {
+			if _, err := entry.Write(buffer[:n]); err != nil {
+				return fail(fmt.Errorf("error writing zip volume: %w", err))
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return fail(fmt.Errorf("error reading source file %s: %w", sourcePath, readErr))
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return fail(fmt.Errorf("error finishing zip archive: %w", err))
+	}
+	if err := volumes.Close(); err != nil {
+		return fail(err)
+	}
+
+	log.Printf("Successfully created %d zip volumes.", volumes.num)
+	events.emit(EventSplitFinished, event{File: sourceInfo.Name(), Strategy: StrategyArchive, Parts: volumes.num})
+	return volumes.entries, nil
+}
+
+// volumeWriter writes a byte stream into numbered volume files of size bytes each,
+// the last one possibly shorter. A volume is only created once it has data.
+type volumeWriter struct {
+	ctx    context.Context
+	dir    string
+	name   string // Source file name the volumes are named after
+	size   int64
+	events *eventStream
+	onPart partCallback
+
+	file    *os.File // Volume being written, nil between volumes
+	written int64    // Bytes written to file
+	num     int      // Number of the last volume created
+	entries []splitPart
+}
+
+// Write implements io.Writer, starting a new volume whenever the current one is full.
+func (w *volumeWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if w.file == nil {
+			if err := w.ctx.Err(); err != nil {
+				return n, err
+			}
+			w.num++
+			path := filepath.Join(w.dir, zipVolumeName(w.name, w.num))
+			f, err := os.Create(path)
+			if err != nil {
+				return n, fmt.Errorf("failed to create volume file %s: %w", path, err)
+			}
+			w.file = f
+			w.written = 0
+		}
+		chunk := p[:min(int64(len(p)), w.size-w.written)]
+		m, err := w.file.Write(chunk)
+		n += m
+		w.written += int64(m)
+		if err != nil {
+			return n, fmt.Errorf("error writing volume file %s: %w", w.file.Name(), err)
+		}
+		p = p[m:]
+		if w.written == w.size {
+			if err := w.finishVolume(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close finishes the last volume.
+func (w *volumeWriter) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	return w.finishVolume()
+}
+
+// finishVolume closes the current volume and hands it to onPart, or keeps it for the caller.
+func (w *volumeWriter) finishVolume() error {
+	path := w.file.Name()
+	err := w.file.Close()
+	w.file = nil
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("error closing volume file %s: %w", path, err)
+	}
+	w.events.emit(EventPartCreated, event{File: filepath.Base(path), Part: w.num, Bytes: w.written})
+	part := splitPart{Path: path}
+	if w.onPart != nil {
+		return w.onPart(w.num, part) // Handed over to onPart
+	}
+	w.entries = append(w.entries, part)
+	return nil
+}
+
+// abort removes the volume being written and every volume not handed to onPart.
+func (w *volumeWriter) abort() {
+	if w.file != nil {
+		w.file.Close()
+		os.Remove(w.file.Name())
+		w.file = nil
+	}
+	cleanupParts(splitPaths(w.entries))
+	w.entries = nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/amarnathcjd/gogram/telegram"
+)
+
+// audioTags are the tags shown by Telegram's audio player.
+type audioTags struct {
+	Title     string
+	Performer string
+}
+
+// probeAudioTags reads the title and artist tags of an audio file. Missing tags are left empty.
+func probeAudioTags(filePath string) audioTags {
+	ffprobePath, err := exec.LookPath("ffprobe")
+	if err != nil {
+		return audioTags{}
+	}
+	cmd := exec.Command(ffprobePath,
+		"-v", "error",
+		"-show_entries", "format_tags",
+		"-of", "json",
+		filePath,
+	)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		log.Printf("Warning: Could not read tags of %s: %v", filePath, err)
+		return audioTags{}
+	}
+	var probeData struct {
+		Format struct {
+			Tags map[string]string `json:"tags"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &probeData); err != nil {
+		return audioTags{}
+	}
+	// Tag names differ in case between containers (TITLE in FLAC, title in MP3)
+	var tags audioTags
+	for key, value := range probeData.Format.Tags {
+		switch strings.ToLower(key) {
+		case "title":
+			tags.Title = value
+		case "artist":
+			tags.Performer = value
+		case "album_artist":
+			if tags.Performer == "" {
+				tags.Performer = value
+			}
+		}
+	}
+	return tags
+}
+
+// splitAudioByDuration splits an audio file into independently playable parts of at
+// most targetPartSize bytes, cutting between audio packets without re-encoding.
+// Tags and cover art are copied into every part.
+// If onPart is non-nil it is called as each part is created.
+func splitAudioByDuration(ctx context.Context, sourcePath string, targetPartSize int64, events *eventStream, onPart partCallback) ([]splitPart, error) {
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg not found in PATH: %w. Please install ffmpeg", err)
+	}
+	ffprobePath, err := exec.LookPath("ffprobe")
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe not found in PATH: %w. Please install ffprobe", err)
+	}
+
+	index, err := probeKeyframeIndex(ctx, ffprobePath, sourcePath, "audio")
+	if err != nil {
+		return nil, fmt.Errorf("could not read the packet index of %s: %w", sourcePath, err)
+	}
+	return splitAtKeyframes(ctx, ffmpegPath, sourcePath, index, targetPartSize, VideoSplitCut, StrategyAudio, events, onPart)
+}
+
+// attribute returns the audio attribute for a file or part of duration seconds.
+// suffix, such as " (Part 2/5)", is appended to the title; without a title tag
+// Telegram shows the file name instead.
+func (t audioTags) attribute(duration float64, suffix string) *telegram.DocumentAttributeAudio {
+	attribute := &telegram.DocumentAttributeAudio{
+		Duration:  int32(math.Round(duration)),
+		Performer: t.Performer,
+	}
+	if t.Title != "" {
+		attribute.Title = t.Title + suffix
+	}
+	return attribute
+}
+
+// sendAudio sends an audio file (or part) as a Telegram audio message, with the
+// duration, title and performer of attribute shown in the player.
+// The returned partResult has MessageID -1 and Error set on failure.
+func sendAudio(client *telegram.Client, chatID, filePath, captionFileName string, partNum int, attribute *telegram.DocumentAttributeAudio, events *eventStream, maxWait time.Duration) partResult {
+	metadata, err := os.Stat(filePath)
+	if err != nil {
+		log.Printf("Error stating file %s for sending: %v", filePath, err)
+		client.SendMessage(chatID, fmt.Sprintf("Error preparing to send %s: %v", captionFileName, err))
+		return partResult{Index: partNum, MessageID: -1, FileName: captionFileName, Error: err.Error()}
+	}
+
+	return sendMedia(client, chatID, captionFileName, metadata.Size(), partNum, events, maxWait, func(onProgress func(totalSize, currentSize int64)) (*telegram.NewMessage, error) {
+		return client.SendMedia(chatID, filePath, &telegram.MediaOptions{
+			ProgressManager: telegram.NewProgressManager(5, onProgress),
+			FileName:        captionFileName,
+			Attributes:      []telegram.DocumentAttribute{attribute},
+		})
+	})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amarnathcjd/gogram/telegram"
+)
+
+const (
+	// BotTokensEnv lists further bot tokens, comma-separated, that parts are spread over.
+	// Every bot must be able to post in the destination chats.
+	BotTokensEnv = "BOT_TOKENS"
+	// MaxPoolFloodSleep is the longest flood wait slept through while other bots can
+	// take over; longer waits fail the request so that the part goes to another bot.
+	MaxPoolFloodSleep = 30 * time.Second
+	// DefaultFloodWait is assumed when a flood wait error does not say how long to wait.
+	DefaultFloodWait = 15 * time.Second
+)
+
+// botClient is one logged-in bot of a botPool, with its health.
+type botClient struct {
+	client *telegram.Client
+	name   string // "bot <id>", from the token; never the token itself
+
+	mu     sync.Mutex
+	health botHealth
+}
+
+// botHealth is what a bot has sent and how it fared, as reported by the job API.
+type botHealth struct {
+	Name       string    `json:"name"`
+	Parts      int       `json:"parts"`
+	Bytes      int64     `json:"bytes"`
+	Floods     int       `json:"floods"`
+	Failures   int       `json:"failures"`
+	FloodUntil time.Time `json:"flood_until,omitzero"` // Not picked before then
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+// botPool spreads the parts of uploads over several bots in turn, skipping bots
+// that are in a flood wait. The first bot is the primary client, which also posts
+// status messages and owns the media cache. A nil *botPool sends everything with
+// the primary client.
+type botPool struct {
+	bots []*botClient
+
+	mu   sync.Mutex
+	next int // Index of the bot whose turn is next
+}
+
+// newBotPool logs in the bots of BotTokensEnv next to primary, which is logged in with
+// primaryToken. It returns nil if there are no further tokens.
+func newBotPool(primary *telegram.Client, primaryToken string) (*botPool, error) {
+	pool := &botPool{bots: []*botClient{{client: primary, name: botName(primaryToken)}}}
+	seen := map[string]bool{primaryToken: true}
+	for _, token := range strings.Split(os.Getenv(BotTokensEnv), ",") {
+		token = strings.TrimSpace(token)
+		if token == "" || seen[token] {
+			continue
+		}
+		seen[token] = true
+		name := botName(token)
+		// Each bot keeps its own session, so that restarts do not log in again
+		client, err := loginBot(token, strings.ReplaceAll(name, " ", "-")+".session")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		pool.bots = append(pool.bots, &botClient{client: client, name: name})
+	}
+	if len(pool.bots) == 1 {
+		return nil, nil
+	}
+	for _, b := range pool.bots {
+		b.health.Name = b.name
+	}
+	log.Printf("Spreading parts over %d bots.", len(pool.bots))
+	return pool, nil
+}
+
+// botName names the bot of a token by its ID, the part before the colon.
+func botName(token string) string {
+	id, _, _ := strings.Cut(token, ":")
+	return "bot " + id
+}
+
+// maxWait returns the longest flood wait a part send sleeps through before it fails,
+// so that another bot of the pool takes the part over, or zero to sleep through any.
+func (p *botPool) maxWait() time.Duration {
+	if p.size() < 2 {
+		return 0
+	}
+	return MaxPoolFloodSleep
+}
+
+// size returns the number of bots in the pool.
+func (p *botPool) size() int {
+	if p == nil {
+		return 0
+	}
+	return len(p.bots)
+}
+
+// acquire returns the bot to send the next part with: the next bot in turn that is
+// not in a flood wait or, if all of them are, the one whose wait ends first, once it has.
+func (p *botPool) acquire(events *eventStream) *botClient {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	now := time.Now()
+	var soonest *botClient
+	var soonestUntil time.Time
+	for n := range len(p.bots) {
+		i := (p.next + n) % len(p.bots)
+		b := p.bots[i]
+		until := b.floodUntil()
+		if !until.After(now) {
+			p.next = (i + 1) % len(p.bots)
+			p.mu.Unlock()
+			return b
+		}
+		if soonest == nil || until.Before(soonestUntil) {
+			soonest, soonestUntil = b, until
+		}
+	}
+	p.mu.Unlock()
+
+	wait := time.Until(soonestUntil)
+	log.Printf("All %d bots are in a flood wait: Waiting %v for %s...", len(p.bots), wait.Round(time.Second), soonest.name)
+	events.emit(EventFloodWait, event{WaitS: wait.Seconds(), Detail: soonest.name})
+	time.Sleep(wait)
+	return soonest
+}
+
+// health returns the health of every bot, primary first.
+func (p *botPool) health() []botHealth {
+	if p == nil {
+		return []botHealth{}
+	}
+	health := make([]botHealth, len(p.bots))
+	for i, b := range p.bots {
+		b.mu.Lock()
+		health[i] = b.health
+		b.mu.Unlock()
+	}
+	return health
+}
+
+// floodUntil returns the time until which the bot is in a flood wait.
+func (b *botClient) floodUntil() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.health.FloodUntil
+}
+
+// report records a part of size bytes the bot sent, or failed to send with errMsg.
+// It reports whether the failure was a flood wait, in which case the bot is not
+// picked again until the wait is over.
+func (b *botClient) report(size int64, errMsg string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if errMsg == "" {
+		b.health.Parts++
+		b.health.Bytes += size
+		return false
+	}
+	b.health.LastError = errMsg
+	wait, isFlood := floodWait(errMsg)
+	if !isFlood {
+		b.health.Failures++
+		return false
+	}
+	if wait == 0 {
+		wait = DefaultFloodWait
+	}
+	b.health.Floods++
+	b.health.FloodUntil = time.Now().Add(wait)
+	log.Printf("Warning: %s is in a flood wait for %v.", b.name, wait)
+	return true
+}
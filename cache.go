@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/amarnathcjd/gogram/telegram"
+	bolt "go.etcd.io/bbolt"
+)
+
+// DefaultMediaCachePath is the media cache used unless --cache is given.
+const DefaultMediaCachePath = "media-cache.db"
+
+var mediaBucket = []byte("media")
+
+// cachedMedia is the Telegram document a file or part was sent as, so that the same
+// content can be sent again by reference instead of being uploaded again.
+type cachedMedia struct {
+	DocumentID    int64     `json:"document_id"`
+	AccessHash    int64     `json:"access_hash"`
+	FileReference []byte    `json:"file_reference"`
+	ChatID        string    `json:"chat_id"` // Where the document was sent, to refresh an expired file reference
+	MessageID     int32     `json:"message_id"`
+	FileName      string    `json:"file_name"`
+	Size          int64     `json:"size"`
+	SHA256        string    `json:"sha256"`
+	CachedAt      time.Time `json:"cached_at"`
+}
+
+// mediaCache maps the content hash, size and name of sent files and parts to the
+// documents they were sent as. The database is only opened for each lookup or update,
+// so that concurrent uploader processes can share it.
+type mediaCache struct {
+	path string
+	mu   sync.Mutex // Serializes access from the workers of one process
+}
+
+// newMediaCache returns the media cache kept in the database at path, or nil if path is empty.
+func newMediaCache(path string) *mediaCache {
+	if path == "" {
+		return nil
+	}
+	return &mediaCache{path: path}
+}
+
+// mediaCacheKey identifies content sent under a name; the name is part of the key
+// because a document sent by reference keeps the name it was uploaded with.
+func mediaCacheKey(sha256 string, size int64, fileName string) []byte {
+	return fmt.Appendf(nil, "%s:%d:%s", sha256, size, fileName)
+}
+
+// update runs fn in a read-write transaction on the cache database.
+func (c *mediaCache) update(fn func(b *bolt.Bucket) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	db, err := bolt.Open(c.path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return fmt.Errorf("failed to open media cache %s: %w", c.path, err)
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(mediaBucket)
+		if err != nil {
+			return err
+		}
+		return fn(b)
+	})
+}
+
+// get returns the cached document for key, or nil if there is none.
+func (c *mediaCache) get(key []byte) *cachedMedia {
+	var entry *cachedMedia
+	err := c.update(func(b *bolt.Bucket) error {
+		data := b.Get(key)
+		if data == nil {
+			return nil
+		}
+		entry = &cachedMedia{}
+		return json.Unmarshal(data, entry)
+	})
+	if err != nil {
+		log.Printf("Warning: Media cache lookup failed: %v", err)
+		return nil
+	}
+	return entry
+}
+
+// put records the document a part was sent as. Parts without one are not cached.
+func (c *mediaCache) put(key []byte, part partResult, chatID string) {
+	if c == nil || part.Error != "" || part.document == nil {
+		return
+	}
+	entry := cachedMedia{
+		DocumentID:    part.document.ID,
+		AccessHash:    part.document.AccessHash,
+		FileReference: part.document.FileReference,
+		ChatID:        chatID,
+		MessageID:     part.MessageID,
+		FileName:      part.FileName,
+		Size:          part.Size,
+		SHA256:        part.SHA256,
+		CachedAt:      time.Now().UTC(),
+	}
+	data, err := json.Marshal(entry)
+	if err == nil {
+		err = c.update(func(b *bolt.Bucket) error { return b.Put(key, data) })
+	}
+	if err != nil {
+		log.Printf("Warning: Could not cache the document of '%s': %v", part.FileName, err)
+	}
+}
+
+// remove forgets key, once its document can no longer be sent.
+func (c *mediaCache) remove(key []byte) {
+	if err := c.update(func(b *bolt.Bucket) error { return b.Delete(key) }); err != nil {
+		log.Printf("Warning: Could not remove stale media cache entry: %v", err)
+	}
+}
+
+// sendCached sends the document that the content of key was sent as before to chatID,
+// refreshing its file reference from the original message once if it has expired.
+// It reports false, and forgets the entry if it is stale, when the content has to be uploaded.
+func (c *mediaCache) sendCached(client *telegram.Client, chatID string, key []byte, partNum int, events *eventStream) (partResult, bool) {
+	if c == nil || key == nil {
+		return partResult{}, false
+	}
+	entry := c.get(key)
+	if entry == nil {
+		return partResult{}, false
+	}
+
+	startTime := time.Now()
+	msg, err := sendDocumentRef(client, chatID, entry.document())
+	if err != nil && telegram.MatchError(err, "FILE_REFERENCE_") {
+		log.Printf("File reference of '%s' expired, refreshing it from message %d.", entry.FileName, entry.MessageID)
+		if original, getErr := client.GetMessageByID(entry.ChatID, entry.MessageID); getErr == nil {
+			if doc := documentOf(original); doc != nil && doc.ID == entry.DocumentID {
+				entry.FileReference = doc.FileReference
+				msg, err = sendDocumentRef(client, chatID, entry.document())
+			}
+		}
+	}
+	if err != nil && handleIfFlood(err, events) {
+		msg, err = sendDocumentRef(client, chatID, entry.document())
+	}
+	if err != nil || msg == nil {
+		log.Printf("Warning: Could not send cached '%s' by reference (%v). Uploading it again.", entry.FileName, err)
+		c.remove(key)
+		return partResult{}, false
+	}
+
+	part := partResult{
+		Index:     partNum,
+		MessageID: msg.ID,
+		FileName:  entry.FileName,
+		Size:      entry.Size,
+		SHA256:    entry.SHA256,
+		UploadS:   time.Since(startTime).Seconds(),
+		Cached:    true,
+		document:  documentOf(msg),
+	}
+	log.Printf("Sent '%s' from the media cache as message %d in %.2f s.", entry.FileName, msg.ID, part.UploadS)
+	events.emit(EventCacheHit, event{File: entry.FileName, Part: partNum, MessageID: msg.ID, Bytes: entry.Size})
+	if part.document != nil && string(part.document.FileReference) != string(entry.FileReference) {
+		c.put(key, part, chatID) // Keep the freshest reference
+	}
+	return part, true
+}
+
+// document returns the cached document.
+func (e *cachedMedia) document() *telegram.DocumentObj {
+	return &telegram.DocumentObj{ID: e.DocumentID, AccessHash: e.AccessHash, FileReference: e.FileReference}
+}
+
+// sendDocumentRef sends an already uploaded document to chatID without uploading it again.
+func sendDocumentRef(client *telegram.Client, chatID string, doc *telegram.DocumentObj) (*telegram.NewMessage, error) {
+	media := &telegram.InputMediaDocument{
+		ID: &telegram.InputDocumentObj{
+			ID:            doc.ID,
+			AccessHash:    doc.AccessHash,
+			FileReference: doc.FileReference,
+		},
+	}
+	return client.SendMedia(chatID, media, &telegram.MediaOptions{})
+}
+
+// documentOf returns the document a message holds, or nil.
+func documentOf(msg *telegram.NewMessage) *telegram.DocumentObj {
+	if msg == nil {
+		return nil
+	}
+	media, ok := msg.Media().(*telegram.MessageMediaDocument)
+	if !ok {
+		return nil
+	}
+	doc, _ := media.Document.(*telegram.DocumentObj)
+	return doc
+}
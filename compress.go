@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression codecs selected per upload with --compress.
+const (
+	CompressNone = "none" // Send files as they are
+	CompressZstd = "zstd" // Zstandard, unless the file is media or its samples do not compress
+)
+
+const (
+	// CompressedSuffix is appended to the name of a compressed file.
+	CompressedSuffix = ".zst"
+	// CompressTempSuffix is appended to the source path to name the compressed copy that is uploaded.
+	CompressTempSuffix = ".upload.zst"
+	// MinCompressSize is the smallest file that is compressed at all.
+	MinCompressSize = 1 * 1024 * 1024
+	// CompressSamples is the number of samples, spread over the file, that are test-compressed.
+	CompressSamples = 8
+	// CompressSampleSize is the size of each sample.
+	CompressSampleSize = 256 * 1024
+	// MaxCompressRatio is the compressed size of the samples, relative to their size,
+	// above which compressing the whole file is not worth the time.
+	MaxCompressRatio = 0.9
+)
+
+// compressionInfo records that the uploaded file is a compressed copy of the original,
+// in the result and the manifest. Sizes and checksums elsewhere are of the compressed copy.
+type compressionInfo struct {
+	Codec        string  `json:"codec"` // One of the Compress* constants
+	OriginalName string  `json:"original_name"`
+	OriginalSize int64   `json:"original_size"`
+	Size         int64   `json:"size"`
+	SampleRatio  float64 `json:"sample_ratio"` // Of the samples that decided to compress
+}
+
+// compressForUpload compresses filePath into a copy next to it when opts.Compress asks
+// for it, the file is not media and a sample of it compresses well. It returns the
+// path of the copy, or "" if the file is sent as it is. A copy left by an earlier run
+// is reused when resume is set, so that its saved upload state still matches.
+func compressForUpload(ctx context.Context, filePath, fileName string, media *mediaInfo, opts uploadOptions, resume bool, events *eventStream) (string, *compressionInfo, error) {
+	if opts.Compress == "" || opts.Compress == CompressNone {
+		return "", nil, nil
+	}
+	if media.isVideo() || media.isAudio() || strings.HasPrefix(media.MimeType, "image/") {
+		log.Printf("Not compressing '%s': %s is already compressed media.", fileName, media.MimeType)
+		return "", nil, nil
+	}
+	sourceInfo, err := os.Stat(filePath)
+	if err != nil {
+		return "", nil, fmt.Errorf("error getting file metadata for %s: %w", filePath, err)
+	}
+	if sourceInfo.Size() < MinCompressSize {
+		return "", nil, nil
+	}
+	info := &compressionInfo{Codec: CompressZstd, OriginalName: fileName, OriginalSize: sourceInfo.Size()}
+
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+	}
+	defer enc.Close()
+	// Sampled again when reusing a copy, so that resumed runs report the same ratio
+	ratio, err := sampleCompressionRatio(filePath, sourceInfo.Size(), enc)
+	if err != nil {
+		return "", nil, err
+	}
+	if ratio > MaxCompressRatio {
+		log.Printf("Not compressing '%s': samples only compress to %.0f%% of their size.", fileName, ratio*100)
+		return "", nil, nil
+	}
+	info.SampleRatio = ratio
+
+	compressedPath := filePath + CompressTempSuffix
+	if resume {
+		if compressed, err := os.Stat(compressedPath); err == nil && compressed.ModTime().After(sourceInfo.ModTime()) {
+			log.Printf("Reusing compressed copy %s from an earlier run.", compressedPath)
+			info.Size = compressed.Size()
+			return compressedPath, info, nil
+		}
+	}
+
+	log.Printf("Compressing '%s' with zstd (samples compress to %.0f%%)...", fileName, ratio*100)
+	if err := compressFile(ctx, filePath, compressedPath, enc); err != nil {
+		return "", nil, err
+	}
+	compressed, err := os.Stat(compressedPath)
+	if err != nil {
+		os.Remove(compressedPath)
+		return "", nil, fmt.Errorf("failed to stat %s: %w", compressedPath, err)
+	}
+	info.Size = compressed.Size()
+	log.Printf("Compressed '%s' from %.2f MB to %.2f MB.", fileName, float64(info.OriginalSize)/1024/1024, float64(info.Size)/1024/1024)
+	events.emit(EventCompressed, event{File: fileName, Strategy: CompressZstd, Bytes: info.Size, Total: info.OriginalSize})
+	return compressedPath, info, nil
+}
+
+// sampleCompressionRatio compresses CompressSamples samples spread evenly over the file,
+// or the whole file if it is smaller, and returns their compressed size relative to their size.
+func sampleCompressionRatio(filePath string, size int64, enc *zstd.Encoder) (float64, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open %s for sampling: %w", filePath, err)
+	}
+	defer f.Close()
+
+	samples, sampleSize := int64(CompressSamples), int64(CompressSampleSize)
+	if size <= samples*sampleSize {
+		samples, sampleSize = 1, size
+	}
+	buf := make([]byte, sampleSize)
+	var read, compressed int64
+	for i := int64(0); i < samples; i++ {
+		offset := (size - sampleSize) * i / max(samples-1, 1)
+		n, err := f.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return 0, fmt.Errorf("error sampling %s: %w", filePath, err)
+		}
+		read += int64(n)
+		compressed += int64(len(enc.EncodeAll(buf[:n], nil)))
+	}
+	if read == 0 {
+		return 1, nil
+	}
+	return float64(compressed) / float64(read), nil
+}
+
+// compressFile writes sourcePath compressed with enc to outputPath. The file only
+// appears under outputPath once it is complete.
+func compressFile(ctx context.Context, sourcePath, outputPath string, enc *zstd.Encoder) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return fmt.Errorf("failed to open source file %s: %w", sourcePath, err)
+	}
+	defer source.Close()
+	tmpPath := outputPath + ".partial"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmpPath, err)
+	}
+
+	enc.Reset(out)
+	_, err = io.Copy(enc, &ctxReader{ctx: ctx, r: source})
+	if closeErr := enc.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, outputPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error compressing %s: %w", sourcePath, err)
+	}
+	return nil
+}
+
+// decompressFile writes the zstd-compressed file at path, decompressed, to outputPath
+// and checks its size against info. The frame checksum is verified while decompressing.
+func decompressFile(path, outputPath string, info *compressionInfo) error {
+	if info.Codec != CompressZstd {
+		return fmt.Errorf("unknown compression codec '%s'", info.Codec)
+	}
+	in, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer in.Close()
+	dec, err := zstd.NewReader(in)
+	if err != nil {
+		return fmt.Errorf("failed to create zstd decoder: %w", err)
+	}
+	defer dec.Close()
+
+	tmpPath := outputPath + ".partial"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmpPath, err)
+	}
+	n, err := io.Copy(out, dec)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && info.OriginalSize > 0 && n != info.OriginalSize {
+		err = fmt.Errorf("decompressed %d bytes, expected %d", n, info.OriginalSize)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, outputPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error decompressing %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,659 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amarnathcjd/gogram/telegram"
+)
+
+// Join methods accepted by --join.
+const (
+	JoinAuto   = "auto"   // Remux video and audio parts, concatenate everything else
+	JoinConcat = "concat" // Concatenate the parts byte for byte
+	JoinRemux  = "remux"  // Join playable parts with ffmpeg's concat demuxer
+)
+
+// DownloadRetries is how many times a failed part download is retried.
+const DownloadRetries = 3
+
+// partNameSuffix matches the " (Part 2/5)" suffix that split uploads add to file names.
+var partNameSuffix = regexp.MustCompile(` \(Part \d+(/\d+)?\)$`)
+
+// downloadPart is one sent part to fetch back from the chat.
+type downloadPart struct {
+	Index     int
+	MessageID int32
+	FileName  string // Name shown in Telegram, if known
+	Size      int64  // Zero if unknown
+	SHA256    string // Empty if unknown
+	Path      string // Set once downloaded
+}
+
+// joinPlan describes which parts make up a file and how to put them back together.
+type joinPlan struct {
+	ChatID   string
+	FileName string // Name of the joined file
+	FileSize int64  // Size of the original file, zero if unknown
+	SHA256   string // Checksum of the original file, empty if unknown
+	Strategy string // Split strategy from the upload result, empty if unknown
+	Join     string // One of the Join* constants
+	Dir      string
+	Keys     *decryptionKeys // Open sealed parts; see encrypt.go
+	Parts    []downloadPart
+
+	// Set if the parts make up a compressed copy, which is decompressed after joining
+	Compression *compressionInfo
+
+	// Parity parts and the size their data parts were padded to; see parityInfo
+	ShardSize int64
+	Parity    []downloadPart
+}
+
+// partPath returns the path data part index (1-based) is downloaded to.
+func (plan *joinPlan) partPath(index int) string {
+	ext := filepath.Ext(plan.FileName)
+	return filepath.Join(plan.Dir, fmt.Sprintf("%s_download%03d%s", strings.TrimSuffix(filepath.Base(plan.FileName), ext), index, ext))
+}
+
+// parityPath returns the path parity part index (1-based) is downloaded to.
+func (plan *joinPlan) parityPath(index int) string {
+	return filepath.Join(plan.Dir, fmt.Sprintf("%s_parity%03d", filepath.Base(plan.FileName), index))
+}
+
+// shardLength returns the size of data part i (0-based) without padding.
+func (plan *joinPlan) shardLength(i int) int64 {
+	if size := plan.Parts[i].Size; size > 0 {
+		return size
+	}
+	return min(plan.ShardSize, plan.FileSize-int64(i)*plan.ShardSize)
+}
+
+// addParity plans the download of the parity parts described by info.
+func (plan *joinPlan) addParity(info *parityInfo) {
+	if info == nil {
+		return
+	}
+	plan.ShardSize = info.ShardSize
+	for _, p := range info.Parts {
+		plan.Parity = append(plan.Parity, downloadPart{
+			Index:     p.Index,
+			MessageID: p.MessageID,
+			FileName:  p.FileName,
+			Size:      p.Size,
+			SHA256:    p.SHA256,
+		})
+	}
+}
+
+// runDownload downloads the parts of a split upload back from Telegram, verifies
+// their checksums and joins them into the original file.
+func runDownload(args []string) {
+	fs := flag.NewFlagSet("download", flag.ExitOnError)
+	resultPath := fs.String("result", "", "Take the chat, message IDs and checksums from an uploader result written by --output json ('-' for stdin)")
+	manifestPath := fs.String("manifest", "", "Take the message IDs and checksums from a downloaded manifest document; the chat is given as the only argument")
+	outputDir := fs.String("dir", ".", "Directory the parts are downloaded to and the joined file is written to")
+	fileName := fs.String("file-name", "", "Name of the joined file (defaults to the uploaded file's name)")
+	joinMethod := fs.String("join", JoinAuto, "How parts are joined: 'concat' appends their bytes, 'remux' joins video or audio parts with ffmpeg, 'auto' picks one")
+	keepParts := fs.Bool("keep-parts", false, "Keep the downloaded parts after joining them")
+	eventsTarget := fs.String("events", "", "Write NDJSON progress events to 'stderr', 'fd:<n>', 'unix:<socket>' or a file path")
+	identity := fs.String("identity", "", "Private key from the keygen command, for files encrypted to its public key (passphrases are read from $"+PassphraseEnv+")")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s download [flags] <chat_id> <message_id>[,<message_id>...]\n       %s download [flags] --result <result.json>\n       %s download [flags] --manifest <name.manifest.json> <chat_id>\n",
+			os.Args[0], os.Args[0], os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *joinMethod != JoinAuto && *joinMethod != JoinConcat && *joinMethod != JoinRemux {
+		log.Fatalf("Invalid --join value '%s': must be '%s', '%s' or '%s'", *joinMethod, JoinAuto, JoinConcat, JoinRemux)
+	}
+
+	keys, err := loadDecryptionKeys(*identity)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	var plan *joinPlan
+	switch {
+	case *resultPath != "":
+		plan, err = planFromResult(*resultPath)
+	case *manifestPath != "" && fs.NArg() >= 1:
+		plan, err = planFromManifest(*manifestPath, fs.Arg(0), keys)
+	case fs.NArg() >= 2:
+		plan, err = planFromMessageIDs(fs.Arg(0), fs.Args()[1:])
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	plan.Join = *joinMethod
+	plan.Dir = *outputDir
+	plan.Keys = keys
+	if *fileName != "" {
+		plan.FileName = *fileName
+	}
+
+	events, err := openEventStream(*eventsTarget)
+	if err != nil {
+		log.Fatalf("Error opening event stream: %v", err)
+	}
+	defer events.Close()
+
+	client, err := newBotClient()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	outputPath, err := downloadAndJoin(context.Background(), client, plan, *keepParts, events)
+	if err != nil {
+		events.Close()
+		log.Fatalf("Error: %v", err)
+	}
+	fmt.Println(outputPath)
+}
+
+// planFromResult reads an uploadResult document and plans the download of its parts.
+func planFromResult(path string) (*joinPlan, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading result %s: %w", path, err)
+	}
+	var result uploadResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("error parsing result %s: %w", path, err)
+	}
+	if len(result.Parts) == 0 {
+		return nil, fmt.Errorf("result %s lists no parts", path)
+	}
+
+	plan := &joinPlan{
+		ChatID:      result.ChatID,
+		FileName:    result.FileName,
+		FileSize:    result.FileSize,
+		SHA256:      result.SHA256,
+		Strategy:    result.Strategy,
+		Compression: result.Compression,
+	}
+	for _, p := range result.Parts {
+		if p.Error != "" || p.MessageID <= 0 {
+			return nil, fmt.Errorf("part %d of '%s' was never sent: %s", p.Index, result.FileName, p.Error)
+		}
+		plan.Parts = append(plan.Parts, downloadPart{
+			Index:     p.Index,
+			MessageID: p.MessageID,
+			FileName:  p.FileName,
+			Size:      p.Size,
+			SHA256:    p.SHA256,
+		})
+	}
+	plan.addParity(result.Parity)
+	return plan, nil
+}
+
+// planFromManifest plans the download of the parts listed in a manifest from chatID.
+// A sealed manifest is decrypted with keys.
+func planFromManifest(path, chatID string, keys *decryptionKeys) (*joinPlan, error) {
+	m, err := readManifest(path, keys)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Parts) == 0 {
+		return nil, fmt.Errorf("manifest %s lists no parts", path)
+	}
+	plan := &joinPlan{
+		ChatID:      chatID,
+		FileName:    m.FileName,
+		FileSize:    m.FileSize,
+		SHA256:      m.SHA256,
+		Strategy:    m.Strategy,
+		Compression: m.Compression,
+	}
+	for _, p := range m.Parts {
+		plan.Parts = append(plan.Parts, downloadPart{
+			Index:     p.Index,
+			MessageID: p.MessageID,
+			FileName:  p.FileName,
+			Size:      p.Size,
+			SHA256:    p.SHA256,
+		})
+	}
+	plan.addParity(m.Parity)
+	return plan, nil
+}
+
+// planFromMessageIDs plans the download of the given messages, in order. ids may be
+// separate arguments or comma-separated. Nothing is known about the parts yet, so
+// their checksums cannot be verified.
+func planFromMessageIDs(chatID string, ids []string) (*joinPlan, error) {
+	plan := &joinPlan{ChatID: chatID}
+	for _, arg := range ids {
+		for _, field := range strings.Split(arg, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			id, err := strconv.ParseInt(field, 10, 32)
+			if err != nil || id <= 0 {
+				return nil, fmt.Errorf("invalid message ID '%s'", field)
+			}
+			plan.Parts = append(plan.Parts, downloadPart{Index: len(plan.Parts) + 1, MessageID: int32(id)})
+		}
+	}
+	if len(plan.Parts) == 0 {
+		return nil, fmt.Errorf("no message IDs given")
+	}
+	return plan, nil
+}
+
+// downloadAndJoin downloads every part of plan, verifies the known sizes and checksums
+// and joins the parts into plan.FileName in plan.Dir, returning the joined file's path.
+// Parts already downloaded with a matching checksum are not downloaded again. Sealed
+// parts are decrypted with plan.Keys as they are downloaded. Parts that cannot be
+// downloaded are rebuilt from the parity parts, if the upload has any. A compressed
+// upload is decompressed after joining.
+// The parts are removed after a successful join unless keepParts is set.
+func downloadAndJoin(ctx context.Context, client *telegram.Client, plan *joinPlan, keepParts bool, events *eventStream) (string, error) {
+	if err := os.MkdirAll(plan.Dir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create directory %s: %w", plan.Dir, err)
+	}
+
+	var missing []int
+	for i := range plan.Parts {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		p := &plan.Parts[i]
+		if err := downloadMessagePart(client, plan, p, events); err != nil {
+			if len(plan.Parity) == 0 || errors.Is(err, errDecryptionKey) {
+				return "", err
+			}
+			log.Printf("Warning: %v. It will be rebuilt from the parity parts.", err)
+			if p.Path != "" {
+				os.Remove(p.Path)
+				p.Path = ""
+			}
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) > 0 {
+		var parityPaths []string
+		for k := range plan.Parity {
+			p := &plan.Parity[k]
+			p.Path = plan.parityPath(p.Index)
+			if err := downloadMessagePart(client, plan, p, events); err != nil {
+				log.Printf("Warning: %v", err)
+				os.Remove(p.Path)
+				p.Path = ""
+				continue
+			}
+			parityPaths = append(parityPaths, p.Path)
+		}
+		if !keepParts {
+			defer cleanupParts(parityPaths)
+		}
+		if err := rebuildDataParts(plan, missing); err != nil {
+			return "", err
+		}
+	}
+
+	paths := make([]string, len(plan.Parts))
+	for i, p := range plan.Parts {
+		paths[i] = p.Path
+	}
+	method := plan.Join
+	if method == JoinAuto {
+		method = chooseJoinMethod(plan, paths)
+	}
+
+	var outputPath string
+	var err error
+	switch {
+	case method == JoinRemux:
+		outputPath = filepath.Join(plan.Dir, filepath.Base(plan.FileName))
+		err = remuxParts(ctx, paths, outputPath)
+	case plan.Strategy == StrategyArchive || strings.HasSuffix(plan.Parts[0].FileName, ".zip.001"):
+		outputPath, err = extractZipVolumes(paths, plan.Dir)
+		if err == nil {
+			err = verifyJoinedFile(plan, outputPath)
+		}
+	default:
+		outputPath = filepath.Join(plan.Dir, filepath.Base(plan.FileName))
+		err = concatParts(paths, outputPath)
+		if err == nil {
+			err = verifyJoinedFile(plan, outputPath)
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("error joining %d parts of '%s': %w", len(paths), plan.FileName, err)
+	}
+	log.Printf("Joined %d parts into %s (%s).", len(paths), outputPath, method)
+	if plan.Compression != nil {
+		compressedPath := outputPath
+		outputPath = filepath.Join(plan.Dir, filepath.Base(plan.Compression.OriginalName))
+		if err := decompressFile(compressedPath, outputPath, plan.Compression); err != nil {
+			return "", err
+		}
+		os.Remove(compressedPath)
+		log.Printf("Decompressed %s into %s.", filepath.Base(compressedPath), outputPath)
+	}
+	events.emit(EventJoinFinished, event{File: filepath.Base(outputPath), Parts: len(paths), Strategy: method})
+
+	if !keepParts {
+		cleanupParts(paths)
+	}
+	return outputPath, nil
+}
+
+// downloadMessagePart downloads the file of one part's message into plan.Dir, retrying
+// after flood waits and other errors, and checks it against the recorded size and checksum.
+func downloadMessagePart(client *telegram.Client, plan *joinPlan, p *downloadPart, events *eventStream) error {
+	if p.Path == "" && plan.FileName != "" {
+		p.Path = plan.partPath(p.Index)
+	}
+	if p.Path != "" && p.SHA256 != "" {
+		if sum, err := fileSHA256(p.Path); err == nil && sum == p.SHA256 {
+			log.Printf("Part %d already downloaded to %s, skipping.", p.Index, p.Path)
+			return nil
+		}
+	}
+
+	msg, err := client.GetMessageByID(plan.ChatID, p.MessageID)
+	if err != nil && handleIfFlood(err, events) {
+		msg, err = client.GetMessageByID(plan.ChatID, p.MessageID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get message %d of part %d: %w", p.MessageID, p.Index, err)
+	}
+	if msg == nil || msg.File == nil {
+		return fmt.Errorf("message %d of part %d has no file", p.MessageID, p.Index)
+	}
+	if p.FileName == "" {
+		p.FileName = msg.File.Name
+	}
+	if plan.FileName == "" {
+		plan.FileName = joinedFileName(p.FileName)
+	}
+
+	if p.Path == "" {
+		p.Path = plan.partPath(p.Index)
+	}
+
+	startTime := time.Now()
+	lastPercent := -1
+	onProgress := func(totalSize, currentSize int64) {
+		if totalSize == 0 {
+			return
+		}
+		percent := float64(currentSize) / float64(totalSize) * 100
+		events.emit(EventDownloadProgress, event{
+			File:     p.FileName,
+			Part:     p.Index,
+			Parts:    len(plan.Parts),
+			Bytes:    currentSize,
+			Total:    totalSize,
+			Percent:  percent,
+			SpeedBps: float64(currentSize) / time.Since(startTime).Seconds(),
+		})
+		if int(percent)/10 != lastPercent {
+			lastPercent = int(percent) / 10
+			log.Printf("Downloading part %d/%d: %.2f/%.2f MB (%d%%)", p.Index, len(plan.Parts),
+				float64(currentSize)/1024/1024, float64(totalSize)/1024/1024, int(percent))
+		}
+	}
+
+	log.Printf("Downloading part %d/%d: '%s' (message %d)", p.Index, len(plan.Parts), p.FileName, p.MessageID)
+	for attempt := 1; ; attempt++ {
+		_, err = msg.Download(&telegram.DownloadOptions{
+			FileName:        p.Path,
+			ProgressManager: telegram.NewProgressManager(5, onProgress),
+		})
+		if err == nil {
+			_, err = openSealedFile(p.Path, plan.Keys)
+		}
+		if err == nil {
+			err = verifyDownloadedPart(*p)
+		}
+		if err == nil {
+			break
+		}
+		if errors.Is(err, errDecryptionKey) {
+			os.Remove(p.Path)
+			return fmt.Errorf("part %d: %w", p.Index, err)
+		}
+		if attempt > DownloadRetries {
+			os.Remove(p.Path)
+			return fmt.Errorf("failed to download part %d after %d attempts: %w", p.Index, attempt, err)
+		}
+		if !handleIfFlood(err, events) {
+			log.Printf("Warning: Download of part %d failed: %v. Retrying...", p.Index, err)
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		events.emit(EventRetry, event{File: p.FileName, Part: p.Index, Attempt: attempt + 1, Error: err.Error()})
+	}
+
+	if p.Size == 0 {
+		if info, err := os.Stat(p.Path); err == nil {
+			p.Size = info.Size()
+		}
+	}
+	log.Printf("Downloaded part %d in %.2f s.", p.Index, time.Since(startTime).Seconds())
+	events.emit(EventPartDownloaded, event{File: p.FileName, Part: p.Index, Parts: len(plan.Parts), MessageID: p.MessageID, Bytes: p.Size})
+	return nil
+}
+
+// verifyDownloadedPart checks a downloaded part against its recorded size and checksum.
+func verifyDownloadedPart(p downloadPart) error {
+	info, err := os.Stat(p.Path)
+	if err != nil {
+		return fmt.Errorf("failed to stat downloaded part %s: %w", p.Path, err)
+	}
+	if p.Size > 0 && info.Size() != p.Size {
+		return fmt.Errorf("downloaded part %d is %d bytes, expected %d", p.Index, info.Size(), p.Size)
+	}
+	if p.SHA256 == "" {
+		return nil
+	}
+	sum, err := fileSHA256(p.Path)
+	if err != nil {
+		return err
+	}
+	if sum != p.SHA256 {
+		return fmt.Errorf("checksum mismatch for part %d: got %s, expected %s", p.Index, sum, p.SHA256)
+	}
+	return nil
+}
+
+// verifyJoinedFile checks a file rebuilt byte for byte against the original's recorded
+// size and checksum. Remuxed video and audio differ from the original in their container,
+// so only their parts are verified.
+func verifyJoinedFile(plan *joinPlan, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat joined file %s: %w", path, err)
+	}
+	if plan.FileSize > 0 && info.Size() != plan.FileSize {
+		return fmt.Errorf("joined file is %d bytes, expected %d", info.Size(), plan.FileSize)
+	}
+	if plan.SHA256 == "" {
+		return nil
+	}
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return err
+	}
+	if sum != plan.SHA256 {
+		return fmt.Errorf("checksum mismatch for joined file: got %s, expected %s", sum, plan.SHA256)
+	}
+	log.Printf("Joined file matches the original's SHA-256 %s.", sum)
+	return nil
+}
+
+// joinedFileName derives the original file name from the name of its first part.
+func joinedFileName(partName string) string {
+	name := strings.TrimSuffix(partNameSuffix.ReplaceAllString(partName, ""), EncryptedSuffix)
+	if strings.HasSuffix(name, ".zip.001") {
+		return strings.TrimSuffix(name, ".001")
+	}
+	return name
+}
+
+// chooseJoinMethod picks JoinRemux for video and audio parts and JoinConcat otherwise.
+// Without a recorded strategy the parts themselves are probed: byte parts of a media
+// file look like media at the start, but ffprobe cannot read the parts after it.
+func chooseJoinMethod(plan *joinPlan, paths []string) string {
+	switch plan.Strategy {
+	case StrategyVideo, StrategyAudio, StrategyTranscode:
+		return JoinRemux
+	case "":
+	default:
+		return JoinConcat
+	}
+	if len(paths) < 2 {
+		return JoinConcat // A single part is the file itself
+	}
+	for _, path := range paths {
+		info, err := classifyMedia(path)
+		if err != nil || info.Container == "" || (!info.isVideo() && !info.isAudio()) {
+			return JoinConcat
+		}
+	}
+	return JoinRemux
+}
+
+// concatParts appends the parts, in order, into outputPath.
+func concatParts(paths []string, outputPath string) error {
+	tmpPath := outputPath + ".partial"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmpPath, err)
+	}
+	for _, path := range paths {
+		if err := appendFile(out, path); err != nil {
+			out.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error closing %s: %w", tmpPath, err)
+	}
+	return os.Rename(tmpPath, outputPath)
+}
+
+// appendFile copies the contents of path to w.
+func appendFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open part %s: %w", path, err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(w, f); err != nil {
+		return fmt.Errorf("error copying part %s: %w", path, err)
+	}
+	return nil
+}
+
+// remuxParts joins playable video or audio parts into outputPath with ffmpeg's concat
+// demuxer, copying the streams without re-encoding.
+func remuxParts(ctx context.Context, paths []string, outputPath string) error {
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return fmt.Errorf("ffmpeg not found in PATH: %w. Please install ffmpeg, or join with --join concat", err)
+	}
+	listPath := outputPath + ".concat.txt"
+	var list strings.Builder
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", path, err)
+		}
+		// The concat list quotes with single quotes; a quote inside is written as '\''
+		fmt.Fprintf(&list, "file '%s'\n", strings.ReplaceAll(abs, "'", `'\''`))
+	}
+	if err := os.WriteFile(listPath, []byte(list.String()), 0o644); err != nil {
+		return fmt.Errorf("failed to write concat list %s: %w", listPath, err)
+	}
+	defer os.Remove(listPath)
+
+	cmd := exec.CommandContext(ctx, ffmpegPath,
+		"-v", "error",
+		"-f", "concat",
+		"-safe", "0", // The list holds absolute paths
+		"-i", listPath,
+		"-c", "copy",
+		"-map", "0",
+		"-movflags", "+faststart",
+		"-y",
+		outputPath,
+	)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	log.Printf("Running ffmpeg: %s", cmd.String())
+	if err := cmd.Run(); err != nil {
+		os.Remove(outputPath)
+		return fmt.Errorf("ffmpeg concat failed: %w\nStderr: %s", err, stderr.String())
+	}
+	return nil
+}
+
+// extractZipVolumes joins zip volumes into a single archive in dir and extracts the
+// file it holds next to it, returning the extracted file's path.
+func extractZipVolumes(paths []string, dir string) (string, error) {
+	zipPath := filepath.Join(dir, strings.TrimSuffix(filepath.Base(paths[0]), filepath.Ext(paths[0]))+".joined.zip")
+	if err := concatParts(paths, zipPath); err != nil {
+		return "", err
+	}
+	defer os.Remove(zipPath)
+
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open joined zip archive: %w", err)
+	}
+	defer zr.Close()
+	if len(zr.File) != 1 {
+		return "", fmt.Errorf("joined zip archive holds %d files, expected 1", len(zr.File))
+	}
+	entry := zr.File[0]
+	outputPath := filepath.Join(dir, filepath.Base(entry.Name)) // Never write outside dir
+	rc, err := entry.Open()
+	if err != nil {
+		return "", fmt.Errorf("failed to read '%s' from the zip archive: %w", entry.Name, err)
+	}
+	defer rc.Close()
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", outputPath, err)
+	}
+	_, err = io.Copy(out, rc) // Checks the entry's CRC-32 at the end
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(outputPath)
+		return "", fmt.Errorf("error extracting '%s': %w", entry.Name, err)
+	}
+	return outputPath, nil
+}
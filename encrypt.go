@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/amarnathcjd/gogram/telegram"
+)
+
+// Encryption modes selected per upload with --encrypt.
+const (
+	EncryptNone       = "none"       // Send files as they are
+	EncryptPassphrase = "passphrase" // Key derived from $ENCRYPTION_PASSPHRASE
+	EncryptRecipient  = "recipient"  // Key sealed to an X25519 public key from the keygen command
+)
+
+const (
+	// EncryptionScheme names the format of sealed documents, recorded in their header and the manifest.
+	EncryptionScheme = "torbot-aes256gcm-v1"
+	// EncryptionChunkSize is the plaintext size of each authenticated chunk of a sealed document.
+	EncryptionChunkSize = 64 * 1024
+	// EncryptedSuffix is appended to the names of sealed documents in Telegram.
+	EncryptedSuffix = ".enc"
+	// PassphraseEnv is the environment variable the passphrase is read from, for uploads and downloads.
+	PassphraseEnv = "ENCRYPTION_PASSPHRASE"
+	// PassphraseIterations is the PBKDF2-SHA256 work factor for passphrase keys.
+	PassphraseIterations = 600000
+	// DefaultIdentityFile is where the keygen command writes the X25519 private key.
+	DefaultIdentityFile = "torbot.key"
+)
+
+// sealMagic starts every sealed document, followed by the header length and the header.
+var sealMagic = []byte("TORBOTE1")
+
+// errDecryptionKey is returned when a sealed document cannot be opened with the keys given,
+// so that downloading it again would not help.
+var errDecryptionKey = errors.New("cannot open encrypted document")
+
+// encryptionInfo records how an upload was encrypted, in its result and manifest.
+// The keys themselves are only in the headers of the sealed documents.
+type encryptionInfo struct {
+	Scheme    string `json:"scheme"`   // EncryptionScheme
+	KeyWrap   string `json:"key_wrap"` // EncryptPassphrase or EncryptRecipient
+	ChunkSize int    `json:"chunk_size"`
+	Recipient string `json:"recipient,omitempty"` // Public key the file key was sealed to
+}
+
+// sealHeader is the JSON header of a sealed document. Every document of an upload
+// carries the same wrapped file key and its own nonce, from which the key of the
+// document is derived, so each part can be opened on its own.
+type sealHeader struct {
+	Scheme       string `json:"scheme"`
+	KeyWrap      string `json:"key_wrap"`
+	ChunkSize    int    `json:"chunk_size"`
+	Salt         []byte `json:"salt,omitempty"`          // Passphrase: PBKDF2 salt
+	Iterations   int    `json:"iterations,omitempty"`    // Passphrase: PBKDF2 work factor
+	EphemeralKey []byte `json:"ephemeral_key,omitempty"` // Recipient: X25519 public key of the sender
+	WrappedKey   []byte `json:"wrapped_key"`             // GCM nonce followed by the sealed file key
+	Nonce        []byte `json:"nonce"`                   // Per document
+}
+
+// sealer encrypts the documents of one upload under a single random file key.
+type sealer struct {
+	info    encryptionInfo
+	header  sealHeader // Without Nonce
+	fileKey []byte
+}
+
+// newSealer generates the file key of an upload and wraps it as opts.Encrypt selects.
+// It returns nil if the upload is not encrypted.
+func newSealer(opts uploadOptions) (*sealer, error) {
+	if opts.Encrypt == "" || opts.Encrypt == EncryptNone {
+		return nil, nil
+	}
+	s := &sealer{
+		info:    encryptionInfo{Scheme: EncryptionScheme, KeyWrap: opts.Encrypt, ChunkSize: EncryptionChunkSize},
+		fileKey: make([]byte, 32),
+	}
+	if _, err := rand.Read(s.fileKey); err != nil {
+		return nil, fmt.Errorf("failed to generate file key: %w", err)
+	}
+	s.header = sealHeader{Scheme: EncryptionScheme, KeyWrap: opts.Encrypt, ChunkSize: EncryptionChunkSize}
+
+	var kek []byte
+	switch opts.Encrypt {
+	case EncryptPassphrase:
+		passphrase := os.Getenv(PassphraseEnv)
+		if passphrase == "" {
+			return nil, fmt.Errorf("%s is not set", PassphraseEnv)
+		}
+		s.header.Salt = make([]byte, 16)
+		if _, err := rand.Read(s.header.Salt); err != nil {
+			return nil, fmt.Errorf("failed to generate salt: %w", err)
+		}
+		s.header.Iterations = PassphraseIterations
+		key, err := passphraseKey(passphrase, s.header.Salt, s.header.Iterations)
+		if err != nil {
+			return nil, err
+		}
+		kek = key
+	case EncryptRecipient:
+		recipient, err := parseRecipient(opts.Recipient)
+		if err != nil {
+			return nil, err
+		}
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+		}
+		shared, err := ephemeral.ECDH(recipient)
+		if err != nil {
+			return nil, fmt.Errorf("key agreement with recipient failed: %w", err)
+		}
+		s.header.EphemeralKey = ephemeral.PublicKey().Bytes()
+		s.info.Recipient = opts.Recipient
+		if kek, err = recipientKey(shared, s.header.EphemeralKey, recipient.Bytes()); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown encryption mode '%s'", opts.Encrypt)
+	}
+
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	s.header.WrappedKey = aead.Seal(nonce, nonce, s.fileKey, []byte(EncryptionScheme))
+	return s, nil
+}
+
+// mode returns the encryption mode of the sealer, or "" for a nil sealer.
+func (s *sealer) mode() string {
+	if s == nil {
+		return ""
+	}
+	return s.info.KeyWrap
+}
+
+// passphraseKey derives the key-encryption key for a passphrase.
+func passphraseKey(passphrase string, salt []byte, iterations int) ([]byte, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key from passphrase: %w", err)
+	}
+	return key, nil
+}
+
+// recipientKey derives the key-encryption key from an X25519 shared secret, bound to both public keys.
+func recipientKey(shared, ephemeralKey, recipientKey []byte) ([]byte, error) {
+	key, err := hkdf.Key(sha256.New, shared, append(bytes.Clone(ephemeralKey), recipientKey...), EncryptionScheme+" x25519", 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key for recipient: %w", err)
+	}
+	return key, nil
+}
+
+// documentKey derives the key of one sealed document from the file key and the document's nonce.
+func documentKey(fileKey, nonce []byte) ([]byte, error) {
+	key, err := hkdf.Key(sha256.New, fileKey, nonce, EncryptionScheme+" document", 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive document key: %w", err)
+	}
+	return key, nil
+}
+
+// newGCM returns AES-256-GCM with key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of chunk i of a document. The last chunk is marked,
+// so that a document cut short at a chunk boundary fails to open.
+func chunkNonce(i int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], uint64(i))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// chunkCount returns the number of chunks that size bytes are sealed in. An empty
+// document still has one, empty, last chunk.
+func chunkCount(size int64, chunkSize int) int64 {
+	return max(1, (size+int64(chunkSize)-1)/int64(chunkSize))
+}
+
+// seal returns a reader over the sealed document holding size bytes of r at offset.
+// Chunks are encrypted as they are read, so the document is never written to disk,
+// and ReadAt may be called concurrently, as uploadRange does.
+func (s *sealer) seal(r io.ReaderAt, offset, size int64) (*sealedReader, error) {
+	header := s.header
+	header.Nonce = make([]byte, 16)
+	if _, err := rand.Read(header.Nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	key, err := documentKey(s.fileKey, header.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode header: %w", err)
+	}
+	prefix := binary.BigEndian.AppendUint32(bytes.Clone(sealMagic), uint32(len(data)))
+	return &sealedReader{
+		r:      io.NewSectionReader(r, offset, size),
+		aead:   aead,
+		prefix: append(prefix, data...),
+		chunks: chunkCount(size, s.header.ChunkSize),
+		chunk:  s.header.ChunkSize,
+	}, nil
+}
+
+// sealedReader is the sealed form of a plaintext section: the prefix, then each chunk
+// followed by its authentication tag.
+type sealedReader struct {
+	r      *io.SectionReader
+	aead   cipher.AEAD
+	prefix []byte // Magic, header length and header
+	chunks int64
+	chunk  int
+}
+
+// Size returns the length of the sealed document.
+func (sr *sealedReader) Size() int64 {
+	return int64(len(sr.prefix)) + sr.r.Size() + sr.chunks*int64(sr.aead.Overhead())
+}
+
+// ReadAt implements io.ReaderAt, sealing the chunks that p overlaps.
+func (sr *sealedReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	sealedChunk := int64(sr.chunk + sr.aead.Overhead())
+	plain := make([]byte, sr.chunk)
+	var sealed []byte
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= sr.Size() {
+			return n, io.EOF
+		}
+		if pos < int64(len(sr.prefix)) {
+			n += copy(p[n:], sr.prefix[pos:])
+			continue
+		}
+		i := (pos - int64(len(sr.prefix))) / sealedChunk
+		m, err := sr.r.ReadAt(plain, i*int64(sr.chunk))
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		sealed = sr.aead.Seal(sealed[:0], chunkNonce(i, i == sr.chunks-1), plain[:m], nil)
+		start := pos - int64(len(sr.prefix)) - i*sealedChunk
+		n += copy(p[n:], sealed[start:])
+	}
+	return n, nil
+}
+
+// sendSealed sends size bytes of sourcePath starting at offset as a sealed document
+// named sealedName, which should end in EncryptedSuffix. A negative size sends the
+// whole file. The returned part records the plaintext size.
+func sendSealed(client *telegram.Client, chatID string, sl *sealer, sourcePath string, offset, size int64, sealedName string, partNum int, events *eventStream, maxWait time.Duration) partResult {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		log.Printf("Error opening %s for sending: %v", sourcePath, err)
+		client.SendMessage(chatID, fmt.Sprintf("Error preparing to send %s: %v", sealedName, err))
+		return partResult{Index: partNum, MessageID: -1, FileName: sealedName, Error: err.Error()}
+	}
+	defer source.Close()
+	if size < 0 {
+		info, err := source.Stat()
+		if err != nil {
+			log.Printf("Error stating file %s for sending: %v", sourcePath, err)
+			return partResult{Index: partNum, MessageID: -1, FileName: sealedName, Error: err.Error()}
+		}
+		size = info.Size()
+	}
+	sealed, err := sl.seal(source, offset, size)
+	if err != nil {
+		log.Printf("Error encrypting %s: %v", sourcePath, err)
+		return partResult{Index: partNum, MessageID: -1, FileName: sealedName, Error: err.Error()}
+	}
+
+	part := sendMedia(client, chatID, sealedName, sealed.Size(), partNum, events, maxWait, func(onProgress func(totalSize, currentSize int64)) (*telegram.NewMessage, error) {
+		file, err := uploadRange(client, io.NewSectionReader(sealed, 0, sealed.Size()), sealedName, events, maxWait, onProgress)
+		if err != nil {
+			return nil, err
+		}
+		media := &telegram.InputMediaUploadedDocument{
+			File:       file,
+			MimeType:   "application/octet-stream",
+			ForceFile:  true,
+			Attributes: []telegram.DocumentAttribute{&telegram.DocumentAttributeFilename{FileName: sealedName}},
+		}
+		return client.SendMedia(chatID, media, &telegram.MediaOptions{FileName: sealedName})
+	})
+	part.Size = size
+	return part
+}
+
+// decryptionKeys are the keys a download may open sealed documents with.
+type decryptionKeys struct {
+	passphrase string
+	identity   *ecdh.PrivateKey
+	fileKeys   map[string][]byte // Unwrapped file keys by wrapped key, so that PBKDF2 runs once per upload
+}
+
+// loadDecryptionKeys reads the passphrase from PassphraseEnv and, if identityPath is
+// set, the X25519 private key written by the keygen command.
+func loadDecryptionKeys(identityPath string) (*decryptionKeys, error) {
+	keys := &decryptionKeys{passphrase: os.Getenv(PassphraseEnv), fileKeys: make(map[string][]byte)}
+	if identityPath == "" {
+		return keys, nil
+	}
+	data, err := os.ReadFile(identityPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading identity %s: %w", identityPath, err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err == nil {
+		keys.identity, err = ecdh.X25519().NewPrivateKey(raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("identity %s is not an X25519 private key: %w", identityPath, err)
+	}
+	return keys, nil
+}
+
+// unwrap returns the file key sealed in header.
+func (k *decryptionKeys) unwrap(header sealHeader) ([]byte, error) {
+	if key, ok := k.fileKeys[string(header.WrappedKey)]; ok {
+		return key, nil
+	}
+	var kek []byte
+	var err error
+	switch header.KeyWrap {
+	case EncryptPassphrase:
+		if k.passphrase == "" {
+			return nil, fmt.Errorf("%w: the file was encrypted with a passphrase; set %s", errDecryptionKey, PassphraseEnv)
+		}
+		kek, err = passphraseKey(k.passphrase, header.Salt, header.Iterations)
+	case EncryptRecipient:
+		if k.identity == nil {
+			return nil, fmt.Errorf("%w: the file was encrypted to a public key; pass its private key with --identity", errDecryptionKey)
+		}
+		ephemeral, parseErr := ecdh.X25519().NewPublicKey(header.EphemeralKey)
+		if parseErr != nil {
+			return nil, fmt.Errorf("invalid ephemeral key: %w", parseErr)
+		}
+		shared, ecdhErr := k.identity.ECDH(ephemeral)
+		if ecdhErr != nil {
+			return nil, fmt.Errorf("key agreement failed: %w", ecdhErr)
+		}
+		kek, err = recipientKey(shared, header.EphemeralKey, k.identity.PublicKey().Bytes())
+	default:
+		return nil, fmt.Errorf("unknown key wrap '%s'", header.KeyWrap)
+	}
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(header.WrappedKey) < aead.NonceSize() {
+		return nil, fmt.Errorf("wrapped key is too short")
+	}
+	nonce, wrapped := header.WrappedKey[:aead.NonceSize()], header.WrappedKey[aead.NonceSize():]
+	key, err := aead.Open(nil, nonce, wrapped, []byte(EncryptionScheme))
+	if err != nil {
+		if header.KeyWrap == EncryptPassphrase {
+			return nil, fmt.Errorf("%w: wrong passphrase", errDecryptionKey)
+		}
+		return nil, fmt.Errorf("%w: the file was encrypted to a different public key", errDecryptionKey)
+	}
+	k.fileKeys[string(header.WrappedKey)] = key
+	return key, nil
+}
+
+// readSealHeader reads the prefix of a sealed document from r. It returns nil
+// without an error if r does not start with sealMagic.
+func readSealHeader(r io.Reader) (*sealHeader, error) {
+	magic := make([]byte, len(sealMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, sealMagic) {
+		return nil, nil
+	}
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, fmt.Errorf("truncated header: %w", err)
+	}
+	if length > 64*1024 {
+		return nil, fmt.Errorf("header of %d bytes is too long", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("truncated header: %w", err)
+	}
+	var header sealHeader
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+	if header.Scheme != EncryptionScheme {
+		return nil, fmt.Errorf("unknown encryption scheme '%s'", header.Scheme)
+	}
+	if header.ChunkSize <= 0 || header.ChunkSize > 16*1024*1024 {
+		return nil, fmt.Errorf("invalid chunk size %d", header.ChunkSize)
+	}
+	return &header, nil
+}
+
+// openSealedFile decrypts path in place if it is a sealed document, reporting whether it was.
+func openSealedFile(path string, keys *decryptionKeys) (bool, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer in.Close()
+	header, err := readSealHeader(in)
+	if err != nil {
+		return true, fmt.Errorf("cannot decrypt %s: %w", path, err)
+	}
+	if header == nil {
+		return false, nil
+	}
+
+	tmpPath := path + ".decrypting"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return true, fmt.Errorf("failed to create %s: %w", tmpPath, err)
+	}
+	err = openSealed(in, header, keys, out)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	in.Close()
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return true, fmt.Errorf("cannot decrypt %s: %w", path, err)
+	}
+	return true, nil
+}
+
+// openSealed decrypts the chunks of a sealed document from in, positioned after its
+// header, to out. Nothing but the chunks may follow the header in in.
+func openSealed(in *os.File, header *sealHeader, keys *decryptionKeys, out io.Writer) error {
+	if keys == nil {
+		return fmt.Errorf("%w: no keys given", errDecryptionKey)
+	}
+	fileKey, err := keys.unwrap(*header)
+	if err != nil {
+		return err
+	}
+	key, err := documentKey(fileKey, header.Nonce)
+	if err != nil {
+		return err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	info, err := in.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", in.Name(), err)
+	}
+	offset, err := in.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", in.Name(), err)
+	}
+	sealedChunk := int64(header.ChunkSize + aead.Overhead())
+	chunks := max(1, (info.Size()-offset+sealedChunk-1)/sealedChunk)
+
+	buf := make([]byte, sealedChunk)
+	var plain []byte
+	for i := int64(0); i < chunks; i++ {
+		n, err := io.ReadFull(in, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("error reading %s: %w", in.Name(), err)
+		}
+		plain, err = aead.Open(plain[:0], chunkNonce(i, i == chunks-1), buf[:n], nil)
+		if err != nil {
+			return fmt.Errorf("chunk %d is corrupted or was tampered with", i)
+		}
+		if _, err := out.Write(plain); err != nil {
+			return fmt.Errorf("error writing decrypted data: %w", err)
+		}
+	}
+	return nil
+}
+
+// readMaybeSealed reads the whole of path, decrypting it with keys if it is a sealed document.
+func readMaybeSealed(path string, keys *decryptionKeys) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header, err := readSealHeader(f)
+	if err != nil {
+		return nil, err
+	}
+	if header == nil {
+		return os.ReadFile(path)
+	}
+	var buf bytes.Buffer
+	if err := openSealed(f, header, keys, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// parseRecipient parses a base64 X25519 public key printed by the keygen command.
+func parseRecipient(s string) (*ecdh.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err == nil {
+		var key *ecdh.PublicKey
+		if key, err = ecdh.X25519().NewPublicKey(raw); err == nil {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid recipient '%s': must be a base64 X25519 public key from the keygen command", s)
+}
+
+// runKeygen writes a new X25519 private key for --encrypt recipient uploads and
+// prints its public key, to be given to the uploader with --recipient.
+func runKeygen(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	out := fs.String("out", DefaultIdentityFile, "File the private key is written to; it must not exist yet")
+	fs.Parse(args)
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatalf("Error generating key: %v", err)
+	}
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		log.Fatalf("Error creating identity file: %v", err)
+	}
+	_, err = fmt.Fprintln(f, base64.StdEncoding.EncodeToString(key.Bytes()))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*out)
+		log.Fatalf("Error writing identity file %s: %v", *out, err)
+	}
+	log.Printf("Wrote private key to %s. Keep it secret; downloads need it with --identity.", *out)
+	fmt.Println(base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()))
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newRecipientSealer returns a sealer for a new X25519 key pair and the keys that open
+// what it seals.
+func newRecipientSealer(t *testing.T) (*sealer, *decryptionKeys) {
+	t.Helper()
+	identity, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl, err := newSealer(uploadOptions{
+		Encrypt:   EncryptRecipient,
+		Recipient: base64.StdEncoding.EncodeToString(identity.PublicKey().Bytes()),
+	})
+	if err != nil {
+		t.Fatalf("newSealer: %v", err)
+	}
+	return sl, &decryptionKeys{identity: identity, fileKeys: make(map[string][]byte)}
+}
+
+// sealedBytes seals size bytes of source at offset and reads the whole sealed document.
+func sealedBytes(t *testing.T, sl *sealer, source []byte, offset, size int64) []byte {
+	t.Helper()
+	sr, err := sl.seal(bytes.NewReader(source), offset, size)
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	sealed, err := io.ReadAll(io.NewSectionReader(sr, 0, sr.Size()))
+	if err != nil {
+		t.Fatalf("reading sealed document: %v", err)
+	}
+	if int64(len(sealed)) != sr.Size() {
+		t.Fatalf("sealed document is %d bytes, Size says %d", len(sealed), sr.Size())
+	}
+	return sealed
+}
+
+// openBytes writes a sealed document to a file and opens it with keys.
+func openBytes(t *testing.T, sealed []byte, keys *decryptionKeys) ([]byte, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "part.enc")
+	if err := os.WriteFile(path, sealed, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return readMaybeSealed(path, keys)
+}
+
+// sealedChunks splits a sealed document into its prefix and its sealed chunks.
+func sealedChunks(t *testing.T, sl *sealer, sealed []byte) ([]byte, [][]byte) {
+	t.Helper()
+	r := bytes.NewReader(sealed)
+	if header, err := readSealHeader(r); err != nil || header == nil {
+		t.Fatalf("readSealHeader = %v, %v", header, err)
+	}
+	prefix := sealed[:len(sealed)-r.Len()]
+	var chunks [][]byte
+	sealedChunk := sl.header.ChunkSize + 16 // GCM tag
+	for rest := sealed[len(prefix):]; len(rest) > 0; {
+		n := min(sealedChunk, len(rest))
+		chunks = append(chunks, rest[:n])
+		rest = rest[n:]
+	}
+	return prefix, chunks
+}
+
+func TestSealOpenRoundTrip(t *testing.T) {
+	sl, keys := newRecipientSealer(t)
+	chunk := int64(EncryptionChunkSize)
+	source := make([]byte, 3*chunk+1000)
+	rand.Read(source)
+
+	tests := []struct {
+		name         string
+		offset, size int64
+	}{
+		{"empty", 0, 0},
+		{"one byte", 0, 1},
+		{"just under a chunk", 0, chunk - 1},
+		{"exactly a chunk", 0, chunk},
+		{"just over a chunk", 0, chunk + 1},
+		{"several chunks", 0, 3 * chunk},
+		{"at an offset", 777, 2*chunk + 5},
+		{"to the end of the source", chunk + 3, int64(len(source)) - chunk - 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealed := sealedBytes(t, sl, source, tt.offset, tt.size)
+			plain, err := openBytes(t, sealed, keys)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			if want := source[tt.offset : tt.offset+tt.size]; !bytes.Equal(plain, want) {
+				t.Errorf("opened %d bytes, want the %d bytes sealed", len(plain), len(want))
+			}
+		})
+	}
+}
+
+func TestSealedReaderReadAt(t *testing.T) {
+	sl, _ := newRecipientSealer(t)
+	source := make([]byte, 2*EncryptionChunkSize+10)
+	rand.Read(source)
+	sr, err := sl.seal(bytes.NewReader(source), 0, int64(len(source)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	whole, err := io.ReadAll(io.NewSectionReader(sr, 0, sr.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Uploads read the sealed document in pieces that do not line up with the chunks
+	for _, off := range []int64{0, 5, int64(len(sr.prefix)), int64(len(sr.prefix)) + EncryptionChunkSize + 3, sr.Size() - 7} {
+		p := make([]byte, 1000)
+		n, err := sr.ReadAt(p, off)
+		if err != nil && err != io.EOF {
+			t.Fatalf("ReadAt(%d): %v", off, err)
+		}
+		if !bytes.Equal(p[:n], whole[off:min(off+1000, int64(len(whole)))]) {
+			t.Errorf("ReadAt(%d) differs from reading the document in one go", off)
+		}
+	}
+}
+
+func TestOpenTruncated(t *testing.T) {
+	sl, keys := newRecipientSealer(t)
+	source := make([]byte, 3*EncryptionChunkSize)
+	rand.Read(source)
+	sealed := sealedBytes(t, sl, source, 0, int64(len(source)))
+	prefix, chunks := sealedChunks(t, sl, sealed)
+
+	tests := []struct {
+		name   string
+		sealed []byte
+	}{
+		{"last chunk dropped", bytes.Join([][]byte{prefix, chunks[0], chunks[1]}, nil)},
+		{"only the first chunk", bytes.Join([][]byte{prefix, chunks[0]}, nil)},
+		{"cut inside the last chunk", sealed[:len(sealed)-100]},
+		{"header only", prefix},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := openBytes(t, tt.sealed, keys); err == nil {
+				t.Errorf("opening a truncated document succeeded")
+			}
+		})
+	}
+}
+
+func TestOpenTamperedLastChunkFlag(t *testing.T) {
+	sl, keys := newRecipientSealer(t)
+	source := make([]byte, 2*EncryptionChunkSize+10)
+	rand.Read(source)
+	sealed := sealedBytes(t, sl, source, 0, int64(len(source)))
+	prefix, chunks := sealedChunks(t, sl, sealed)
+
+	// Seal chunks again with the document key, as only the key holder could
+	header, err := readSealHeader(bytes.NewReader(sealed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := documentKey(sl.fileKey, header.Nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reseal := func(i int64, last bool) []byte {
+		plain, err := aead.Open(nil, chunkNonce(i, i == int64(len(chunks))-1), chunks[i], nil)
+		if err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+		return aead.Seal(nil, chunkNonce(i, last), plain, nil)
+	}
+
+	tests := []struct {
+		name   string
+		sealed []byte
+	}{
+		{"last chunk not marked", bytes.Join([][]byte{prefix, chunks[0], chunks[1], reseal(2, false)}, nil)},
+		{"middle chunk marked", bytes.Join([][]byte{prefix, chunks[0], reseal(1, true), chunks[2]}, nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := openBytes(t, tt.sealed, keys); err == nil {
+				t.Errorf("opening a document with a tampered last-chunk flag succeeded")
+			}
+		})
+	}
+
+	flipped := bytes.Clone(sealed)
+	flipped[len(prefix)+10] ^= 1
+	if _, err := openBytes(t, flipped, keys); err == nil {
+		t.Errorf("opening a document with a flipped ciphertext bit succeeded")
+	}
+}
+
+func TestOpenWrongKey(t *testing.T) {
+	sl, _ := newRecipientSealer(t)
+	_, otherKeys := newRecipientSealer(t)
+	sealed := sealedBytes(t, sl, []byte("secret"), 0, 6)
+
+	if _, err := openBytes(t, sealed, otherKeys); !errors.Is(err, errDecryptionKey) {
+		t.Errorf("open with another identity = %v, want errDecryptionKey", err)
+	}
+	if _, err := openBytes(t, sealed, nil); !errors.Is(err, errDecryptionKey) {
+		t.Errorf("open without keys = %v, want errDecryptionKey", err)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types written to the event stream, one JSON object per line.
+const (
+	EventMimeDetected      = "mime_detected"
+	EventCompressed        = "compressed"
+	EventSplitStarted      = "split_started"
+	EventPartCreated       = "part_created"
+	EventPartResplit       = "part_resplit"
+	EventSplitFallback     = "split_fallback"
+	EventTranscodeProgress = "transcode_progress"
+	EventSplitFinished     = "split_finished"
+	EventUploadStarted     = "upload_started"
+	EventUploadProgress    = "upload_progress"
+	EventPartFinished      = "part_finished"
+	EventCacheHit          = "cache_hit"
+	EventCopyFinished      = "copy_finished"
+	EventDownloadProgress  = "download_progress"
+	EventPartDownloaded    = "part_downloaded"
+	EventJoinFinished      = "join_finished"
+	EventFloodWait         = "flood_wait"
+	EventRetry             = "retry"
+	EventResult            = "result"
+)
+
+// event is a single progress event. Only the fields relevant to the event type are set.
+type event struct {
+	Type      string        `json:"type"`
+	Time      time.Time     `json:"time"`
+	JobID     string        `json:"job_id,omitempty"`
+	ChatID    string        `json:"chat_id,omitempty"`
+	File      string        `json:"file,omitempty"`
+	Part      int           `json:"part,omitempty"`
+	Parts     int           `json:"parts,omitempty"`
+	MimeType  string        `json:"mime_type,omitempty"`
+	Media     *mediaInfo    `json:"media,omitempty"`
+	Strategy  string        `json:"strategy,omitempty"`
+	Bytes     int64         `json:"bytes,omitempty"`
+	Total     int64         `json:"total,omitempty"`
+	Percent   float64       `json:"percent,omitempty"`
+	SpeedBps  float64       `json:"speed_bps,omitempty"`
+	MessageID int32         `json:"message_id,omitempty"`
+	WaitS     float64       `json:"wait_seconds,omitempty"`
+	Attempt   int           `json:"attempt,omitempty"`
+	Error     string        `json:"error,omitempty"`
+	Detail    string        `json:"detail,omitempty"`
+	Result    *uploadResult `json:"result,omitempty"`
+}
+
+// eventStream writes newline-delimited JSON events. A nil *eventStream is valid
+// and discards all events, so callers never need to check whether events are enabled.
+type eventStream struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+
+	// Set on per-job streams created by forJob.
+	parent *eventStream
+	jobID  string
+	hook   func(event)
+}
+
+// openEventStream opens an event stream for the --events flag value:
+//
+//	stderr        write to standard error, interleaved with log lines
+//	fd:<n>        write to an inherited file descriptor
+//	unix:<path>   connect to a Unix domain socket
+//	<path>        append to a file
+//
+// An empty target disables events and returns nil.
+func openEventStream(target string) (*eventStream, error) {
+	switch {
+	case target == "":
+		return nil, nil
+	case target == "stderr":
+		return &eventStream{w: os.Stderr}, nil
+	case strings.HasPrefix(target, "fd:"):
+		fd, err := strconv.Atoi(strings.TrimPrefix(target, "fd:"))
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("invalid event file descriptor '%s'", target)
+		}
+		f := os.NewFile(uintptr(fd), "events")
+		if f == nil {
+			return nil, fmt.Errorf("event file descriptor %d is not valid", fd)
+		}
+		return &eventStream{w: f, closer: f}, nil
+	case strings.HasPrefix(target, "unix:"):
+		conn, err := net.Dial("unix", strings.TrimPrefix(target, "unix:"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to event socket %s: %w", target, err)
+		}
+		return &eventStream{w: conn, closer: conn}, nil
+	default:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open event file %s: %w", target, err)
+		}
+		return &eventStream{w: f, closer: f}, nil
+	}
+}
+
+// emit writes a single event, stamping its type and time.
+func (s *eventStream) emit(eventType string, ev event) {
+	if s == nil {
+		return
+	}
+	ev.Type = eventType
+	ev.Time = time.Now().UTC()
+	s.write(ev)
+}
+
+// write delivers a stamped event to the hook and the underlying writer (or parent stream).
+func (s *eventStream) write(ev event) {
+	if s.jobID != "" {
+		ev.JobID = s.jobID
+	}
+	if s.hook != nil {
+		s.hook(ev)
+	}
+	if s.parent != nil {
+		s.parent.write(ev)
+		return
+	}
+	if s.w == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	line, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("Warning: Failed to encode %s event: %v", ev.Type, err)
+		return
+	}
+	if _, err := s.w.Write(append(line, '\n')); err != nil {
+		log.Printf("Warning: Failed to write %s event: %v", ev.Type, err)
+	}
+}
+
+// forJob returns a stream that tags every event with jobID, passes it to hook
+// and forwards it to s. It is safe to call on a nil stream.
+func (s *eventStream) forJob(jobID string, hook func(event)) *eventStream {
+	return &eventStream{parent: s, jobID: jobID, hook: hook}
+}
+
+// Close closes the underlying writer if the stream owns it.
+func (s *eventStream) Close() error {
+	if s == nil || s.parent != nil || s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"unicode/utf8"
+)
+
+// Split methods tried in order for video and audio files, recorded in uploadResult.SplitMethod.
+const (
+	SplitMethodKeyframe = "keyframe" // Cuts planned at keyframes from the packet index
+	SplitMethodBitrate  = "bitrate"  // Plain ffmpeg cuts, with lengths estimated from the average bitrate
+	SplitMethodGeneric  = "generic"  // Byte parts that only play once joined again
+)
+
+// MaxSplitFailureLength caps how much of a split error is quoted in the chat.
+const MaxSplitFailureLength = 200
+
+// splitMethodNames are the names of the split methods shown in the chat.
+var splitMethodNames = map[string]string{
+	SplitMethodKeyframe: "keyframe split",
+	SplitMethodBitrate:  "plain ffmpeg split",
+	SplitMethodGeneric:  "generic byte split",
+}
+
+// errNoMediaSplit is returned by splitMedia when every media split method failed
+// before producing a part, so the file can still be sent as generic parts.
+var errNoMediaSplit = errors.New("no media split method succeeded")
+
+// splitFailure records why a split method was given up.
+type splitFailure struct {
+	Method string `json:"method"`
+	Error  string `json:"error"`
+}
+
+// mediaSplitMethod is one way of splitting a media file into playable parts.
+type mediaSplitMethod struct {
+	name  string
+	split func(onPart partCallback) ([]splitPart, error)
+}
+
+// splitMedia splits a video or audio file into playable parts, trying the keyframe
+// split first and the plain ffmpeg split after it. The method used and the failures
+// of earlier ones are recorded in the result.
+//
+// A method that fails after handing parts to onPart is not followed by another,
+// since the parts already sent cannot be taken back. If every method fails before
+// producing a part, the error wraps errNoMediaSplit.
+func (s *partSender) splitMedia(ctx context.Context, filePath string, onPart partCallback) ([]splitPart, error) {
+	strategy := StrategyVideo
+	methods := []mediaSplitMethod{
+		{SplitMethodKeyframe, func(onPart partCallback) ([]splitPart, error) {
+			return splitVideoBySize(ctx, filePath, MaxFileSize, s.opts.VideoSplit, s.events, onPart)
+		}},
+	}
+	if s.isAudio {
+		strategy = StrategyAudio
+		methods[0].split = func(onPart partCallback) ([]splitPart, error) {
+			return splitAudioByDuration(ctx, filePath, MaxFileSize, s.events, onPart)
+		}
+	}
+	methods = append(methods, mediaSplitMethod{SplitMethodBitrate, func(onPart partCallback) ([]splitPart, error) {
+		return splitVideoByBitrate(ctx, filePath, MaxFileSize, strategy, s.events, onPart)
+	}})
+
+	handedOver := 0
+	counted := onPart
+	if onPart != nil {
+		counted = func(partNum int, part splitPart) error {
+			handedOver++
+			return onPart(partNum, part)
+		}
+	}
+
+	var errs []error
+	for _, m := range methods {
+		log.Printf("Splitting '%s' with the %s...", s.name, splitMethodNames[m.name])
+		parts, err := m.split(counted)
+		if err == nil {
+			s.useSplitMethod(m.name)
+			return parts, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if handedOver > 0 {
+			return nil, fmt.Errorf("%s failed after %d parts: %w", splitMethodNames[m.name], handedOver, err)
+		}
+		s.recordSplitFailure(m.name, err)
+		errs = append(errs, fmt.Errorf("%s: %w", splitMethodNames[m.name], err))
+	}
+	return nil, fmt.Errorf("%w: %w", errNoMediaSplit, errors.Join(errs...))
+}
+
+// fallBackToGeneric switches the sender to generic byte parts after every media
+// split method failed. The saved state, if already created, is switched too.
+func (s *partSender) fallBackToGeneric(fileSize int64) {
+	s.isVideo = false
+	s.isAudio = false
+	s.total = int((fileSize + PartSize - 1) / PartSize)
+	if s.opts.Archive == ArchiveZip {
+		s.total = 0 // Known once the archive is written
+	}
+	if s.state != nil {
+		s.state.Strategy = StrategyGeneric
+		s.state.PartSize = PartSize
+		if s.opts.Archive == ArchiveZip {
+			s.state.Strategy = StrategyArchive
+			s.state.PartSize = 0
+		}
+	}
+	s.useSplitMethod(SplitMethodGeneric)
+}
+
+// recordSplitFailure records in the result and the event stream that method failed with err.
+func (s *partSender) recordSplitFailure(method string, err error) {
+	log.Printf("Warning: The %s of '%s' failed: %v", splitMethodNames[method], s.name, err)
+	s.result.SplitFailures = append(s.result.SplitFailures, splitFailure{Method: method, Error: err.Error()})
+	s.events.emit(EventSplitFallback, event{File: s.name, Strategy: method, Error: err.Error()})
+}
+
+// useSplitMethod records the split method that produced the parts.
+func (s *partSender) useSplitMethod(method string) {
+	s.result.SplitMethod = method
+	if len(s.result.SplitFailures) > 0 {
+		log.Printf("Split '%s' with the %s after %d failed method(s).", s.name, splitMethodNames[method], len(s.result.SplitFailures))
+	}
+}
+
+// splitNote describes for the chat which split method was used and why earlier ones
+// failed. It is empty if the file was not split, or split by a resumed earlier run.
+func (s *partSender) splitNote() string {
+	if s.result.SplitMethod == "" {
+		return ""
+	}
+	note := "Split method: " + splitMethodNames[s.result.SplitMethod]
+	for _, f := range s.result.SplitFailures {
+		reason, _, _ := strings.Cut(f.Error, "\n") // Drop quoted ffmpeg output
+		if len(reason) > MaxSplitFailureLength {
+			cut := MaxSplitFailureLength
+			for cut > 0 && !utf8.RuneStart(reason[cut]) {
+				cut-- // Never cut a character in half
+			}
+			reason = reason[:cut] + "..."
+		}
+		note += fmt.Sprintf("\n%s failed: %s", splitMethodNames[f.Method], reason)
+	}
+	return note
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/amarnathcjd/gogram/telegram"
+)
+
+// copyResult describes the delivery of an upload to one further chat. Each chat
+// succeeds or fails on its own; a failed copy does not fail the upload.
+type copyResult struct {
+	ChatID            string       `json:"chat_id"`
+	Parts             []partResult `json:"parts"`
+	Parity            []partResult `json:"parity,omitempty"`
+	ManifestMessageID int32        `json:"manifest_message_id,omitempty"`
+	Success           bool         `json:"success"`
+	Error             string       `json:"error,omitempty"`
+	ElapsedS          float64      `json:"elapsed_seconds"`
+}
+
+// validateCopyTo checks the further chats of an upload to chatID.
+func validateCopyTo(chatID string, copyTo []string) error {
+	seen := map[string]bool{chatID: true}
+	for _, id := range copyTo {
+		if id == "" {
+			return fmt.Errorf("empty chat ID in destinations")
+		}
+		if seen[id] {
+			return fmt.Errorf("chat %s is given more than once", id)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// deliverCopies sends the documents of a finished upload to each of chatIDs by
+// reference, so that nothing is uploaded twice, followed by a manifest listing the
+// message IDs in that chat if the upload had one. The copies are recorded in result.
+func deliverCopies(ctx context.Context, client *telegram.Client, result *uploadResult, chatIDs []string, events *eventStream) {
+	for _, chatID := range chatIDs {
+		copied := copyResult{ChatID: chatID, Parts: []partResult{}}
+		startTime := time.Now()
+		var err error
+		switch {
+		case !result.Success:
+			err = fmt.Errorf("not copied: the upload to %s failed", result.ChatID)
+		case ctx.Err() != nil:
+			err = ctx.Err()
+		default:
+			err = copyUpload(ctx, client, result, &copied, events)
+		}
+		copied.ElapsedS = time.Since(startTime).Seconds()
+		if err != nil {
+			copied.Error = err.Error()
+			log.Printf("Warning: Could not copy '%s' to %s: %v", result.FileName, chatID, err)
+		} else {
+			copied.Success = true
+			log.Printf("Copied '%s' to %s (%d parts) in %.2f s.", result.FileName, chatID, len(copied.Parts), copied.ElapsedS)
+		}
+		events.emit(EventCopyFinished, event{File: result.FileName, ChatID: chatID, Parts: len(copied.Parts), MessageID: copied.ManifestMessageID, Error: copied.Error})
+		result.Copies = append(result.Copies, copied)
+	}
+}
+
+// copyUpload sends the parts, parity parts and manifest of result to copied.ChatID.
+func copyUpload(ctx context.Context, client *telegram.Client, result *uploadResult, copied *copyResult, events *eventStream) error {
+	for _, part := range result.Parts {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		sent, err := copyPart(client, result.ChatID, copied.ChatID, part, events)
+		if err != nil {
+			return fmt.Errorf("part %d: %w", part.Index, err)
+		}
+		copied.Parts = append(copied.Parts, sent)
+	}
+	if result.Parity != nil {
+		for _, part := range result.Parity.Parts {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			sent, err := copyPart(client, result.ChatID, copied.ChatID, part, events)
+			if err != nil {
+				return fmt.Errorf("parity part %d: %w", part.Index, err)
+			}
+			copied.Parity = append(copied.Parity, sent)
+		}
+	}
+	if result.manifest == nil {
+		return nil
+	}
+
+	m := *result.manifest
+	m.Parts = append([]manifestPart(nil), result.manifest.Parts...)
+	for i := range m.Parts {
+		m.Parts[i].MessageID = copied.Parts[i].MessageID
+	}
+	if m.Parity != nil {
+		parity := *m.Parity
+		parity.Parts = copied.Parity
+		m.Parity = &parity
+	}
+	msgID, err := sendManifestDocument(client, copied.ChatID, &m, result.sealer, events)
+	if err != nil {
+		return err
+	}
+	copied.ManifestMessageID = msgID
+	return nil
+}
+
+// copyPart sends the document of part, which was sent to sourceChatID, to chatID.
+// The document is looked up from its message when the upload did not keep it, or
+// when its file reference has expired.
+func copyPart(client *telegram.Client, sourceChatID, chatID string, part partResult, events *eventStream) (partResult, error) {
+	doc := part.document
+	refreshed := false
+	if doc == nil {
+		var err error
+		if doc, err = lookupDocument(client, sourceChatID, part.MessageID); err != nil {
+			return partResult{}, err
+		}
+		refreshed = true
+	}
+
+	startTime := time.Now()
+	msg, err := sendDocumentRef(client, chatID, doc)
+	if err != nil && !refreshed && telegram.MatchError(err, "FILE_REFERENCE_") {
+		log.Printf("File reference of '%s' expired, refreshing it from message %d.", part.FileName, part.MessageID)
+		if doc, err = lookupDocument(client, sourceChatID, part.MessageID); err == nil {
+			msg, err = sendDocumentRef(client, chatID, doc)
+		}
+	}
+	if err != nil && handleIfFlood(err, events) {
+		msg, err = sendDocumentRef(client, chatID, doc)
+	}
+	if err != nil {
+		return partResult{}, err
+	}
+	if msg == nil {
+		return partResult{}, fmt.Errorf("no message returned")
+	}
+
+	sent := part
+	sent.MessageID = msg.ID
+	sent.UploadS = time.Since(startTime).Seconds()
+	sent.Resumed = false
+	sent.document = documentOf(msg)
+	log.Printf("Copied '%s' to %s as message %d.", part.FileName, chatID, msg.ID)
+	return sent, nil
+}
+
+// lookupDocument returns the document held by message msgID in chatID.
+func lookupDocument(client *telegram.Client, chatID string, msgID int32) (*telegram.DocumentObj, error) {
+	msg, err := client.GetMessageByID(chatID, msgID)
+	if err != nil {
+		return nil, fmt.Errorf("could not get message %d: %w", msgID, err)
+	}
+	doc := documentOf(msg)
+	if doc == nil {
+		return nil, fmt.Errorf("message %d holds no document", msgID)
+	}
+	return doc, nil
+}
@@ -5,9 +5,14 @@ go 1.24.1
 require (
 	github.com/amarnathcjd/gogram v1.5.10-0.20250420072643-d6776b103a80
 	github.com/joho/godotenv v1.5.1
+	github.com/klauspost/compress v1.18.0
+	github.com/klauspost/reedsolomon v1.10.0
+	go.etcd.io/bbolt v1.4.3
 )
 
 require (
+	github.com/klauspost/cpuid/v2 v2.2.10 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	golang.org/x/net v0.35.0 // indirect
+	golang.org/x/sys v0.30.0 // indirect
 )
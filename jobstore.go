@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// DefaultJobDBPath is the embedded database used by serve mode unless --db is given.
+const DefaultJobDBPath = "jobs.db"
+
+var (
+	jobsBucket   = []byte("jobs")
+	statesBucket = []byte("states")
+)
+
+// jobStore persists daemon jobs and their per-part upload state in a bbolt database,
+// so that queued and in-flight jobs survive a restart.
+type jobStore struct {
+	db *bolt.DB
+}
+
+// openJobStore opens (or creates) the job database at path.
+func openJobStore(path string) (*jobStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open job database %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{jobsBucket, statesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize job database %s: %w", path, err)
+	}
+	return &jobStore{db: db}, nil
+}
+
+func (s *jobStore) Close() error {
+	return s.db.Close()
+}
+
+// putJob saves a job record.
+func (s *jobStore) putJob(j job) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return fmt.Errorf("failed to encode job %s: %w", j.ID, err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).Put([]byte(j.ID), data)
+	})
+}
+
+// loadJobs returns all saved jobs, oldest first.
+func (s *jobStore) loadJobs() ([]*job, error) {
+	var jobs []*job
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(k, v []byte) error {
+			var j job
+			if err := json.Unmarshal(v, &j); err != nil {
+				return fmt.Errorf("failed to decode job %s: %w", k, err)
+			}
+			jobs = append(jobs, &j)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].CreatedAt.Before(jobs[b].CreatedAt) })
+	return jobs, nil
+}
+
+// stateFor returns a stateStore that keeps the upload state of job id in the database.
+func (s *jobStore) stateFor(id string) stateStore {
+	return &jobStateStore{store: s, key: []byte(id)}
+}
+
+// jobStateStore is the stateStore of a single daemon job.
+type jobStateStore struct {
+	store *jobStore
+	key   []byte
+}
+
+func (s *jobStateStore) loadState() (*uploadState, error) {
+	var st *uploadState
+	err := s.store.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(statesBucket).Get(s.key)
+		if data == nil {
+			return nil
+		}
+		st = &uploadState{}
+		return json.Unmarshal(data, st)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load state for job %s: %w", s.key, err)
+	}
+	return st, nil
+}
+
+func (s *jobStateStore) saveState(st *uploadState) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return fmt.Errorf("failed to encode state for job %s: %w", s.key, err)
+	}
+	return s.store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(statesBucket).Put(s.key, data)
+	})
+}
+
+func (s *jobStateStore) clearState() error {
+	return s.store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(statesBucket).Delete(s.key)
+	})
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// KeyframeCutOffsetSec moves planned cut points just past each keyframe, so that a
+// seek never lands on the keyframe before it and a segment's end never includes the
+// next keyframe. It must stay well below the duration of a single frame.
+const KeyframeCutOffsetSec = 0.001
+
+// mediaSegment is a planned cut of a video or audio file: Duration seconds starting at Start,
+// covering the keyframe intervals First up to (not including) Last.
+type mediaSegment struct {
+	Start    float64
+	Duration float64
+	Bytes    int64 // Estimated size of the part, including container overhead
+	First    int
+	Last     int
+	Precut   string // File already written by the segment muxer, if any
+}
+
+// keyframeIndex is the keyframe layout of a media file, read once and used to plan and
+// re-plan cut points without probing the source again.
+type keyframeIndex struct {
+	keyframes     []float64 // Keyframe times of the main stream, ascending
+	intervalBytes []int64   // Packet bytes of all streams from each keyframe to the next
+	endTime       float64
+	overhead      float64 // Source size divided by the total packet size
+}
+
+// mediaPacket is a single demuxed packet as listed by ffprobe. Times are relative
+// to the start of the file, as ffmpeg's -ss expects them.
+type mediaPacket struct {
+	stream    int
+	codecType string // "video", "audio", ...
+	key       bool
+	time      float64
+	end       float64
+	size      int64
+}
+
+// probePackets lists every packet of filePath with ffprobe in a single pass.
+func probePackets(ctx context.Context, ffprobePath, filePath string) ([]mediaPacket, error) {
+	cmd := exec.CommandContext(ctx, ffprobePath,
+		"-v", "error",
+		"-show_entries", "packet=codec_type,stream_index,pts_time,dts_time,duration_time,size,flags:format=start_time",
+		"-of", "compact",
+		filePath,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run ffprobe (packets) for %s: %w", filePath, err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to run ffprobe (packets) for %s: %w", filePath, err)
+	}
+
+	var packets []mediaPacket
+	startTime := 0.0
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		section, fields, _ := strings.Cut(scanner.Text(), "|")
+		values := make(map[string]string)
+		for _, field := range strings.Split(fields, "|") {
+			if key, value, ok := strings.Cut(field, "="); ok {
+				values[key] = value
+			}
+		}
+		switch section {
+		case "packet":
+			if pkt, ok := parsePacket(values); ok {
+				packets = append(packets, pkt)
+			}
+		case "format":
+			if t, err := strconv.ParseFloat(values["start_time"], 64); err == nil {
+				startTime = t
+			}
+		}
+	}
+	scanErr := scanner.Err()
+	if scanErr != nil {
+		io.Copy(io.Discard, stdout) // Let ffprobe finish writing so Wait returns
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("ffprobe (packets) failed for %s: %w\nStderr: %s", filePath, err, stderr.String())
+	}
+	if scanErr != nil {
+		return nil, fmt.Errorf("failed to read ffprobe packet list for %s: %w", filePath, scanErr)
+	}
+
+	for i := range packets {
+		packets[i].time -= startTime
+		packets[i].end -= startTime
+	}
+	return packets, nil
+}
+
+// parsePacket converts one ffprobe packet entry. Packets without a usable
+// timestamp or size are skipped.
+func parsePacket(values map[string]string) (mediaPacket, bool) {
+	t, err := strconv.ParseFloat(values["pts_time"], 64)
+	if err != nil {
+		// Fall back to the decode timestamp (e.g. for packets with no pts)
+		if t, err = strconv.ParseFloat(values["dts_time"], 64); err != nil {
+			return mediaPacket{}, false
+		}
+	}
+	size, err := strconv.ParseInt(values["size"], 10, 64)
+	if err != nil {
+		return mediaPacket{}, false
+	}
+	stream, _ := strconv.Atoi(values["stream_index"])
+	duration, _ := strconv.ParseFloat(values["duration_time"], 64)
+	return mediaPacket{
+		stream:    stream,
+		codecType: values["codec_type"],
+		key:       strings.HasPrefix(values["flags"], "K"),
+		time:      t,
+		end:       t + duration,
+		size:      size,
+	}, true
+}
+
+// probeKeyframeIndex reads the packet index of sourcePath once and sums the real
+// packet sizes of every stream between keyframes of the main stream of codecType
+// ("video" or "audio"). Every audio packet is a keyframe, so audio can be cut anywhere.
+func probeKeyframeIndex(ctx context.Context, ffprobePath, sourcePath, codecType string) (*keyframeIndex, error) {
+	sourceInfo, err := os.Stat(sourcePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file info for %s: %w", sourcePath, err)
+	}
+	packets, err := probePackets(ctx, ffprobePath, sourcePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cut on the stream with the most packets, which skips cover art and thumbnails
+	packetCounts := make(map[int]int)
+	for _, p := range packets {
+		if p.codecType == codecType {
+			packetCounts[p.stream]++
+		}
+	}
+	mainStream, most := -1, 0
+	for stream, count := range packetCounts {
+		if count > most || (count == most && stream < mainStream) {
+			mainStream, most = stream, count
+		}
+	}
+	if mainStream < 0 {
+		return nil, fmt.Errorf("no %s packets found in %s", codecType, sourcePath)
+	}
+
+	ix := &keyframeIndex{}
+	var payload int64
+	for _, p := range packets {
+		payload += p.size
+		ix.endTime = max(ix.endTime, p.end, p.time)
+		if p.stream == mainStream && p.key {
+			ix.keyframes = append(ix.keyframes, p.time)
+		}
+	}
+	if len(ix.keyframes) == 0 {
+		return nil, fmt.Errorf("no keyframes found in %s", sourcePath)
+	}
+	if payload <= 0 {
+		return nil, fmt.Errorf("packet sizes of %s add up to zero", sourcePath)
+	}
+	sort.Float64s(ix.keyframes)
+	ix.keyframes = compactFloats(ix.keyframes)
+
+	// Bytes of every stream between consecutive keyframes, by presentation time
+	ix.intervalBytes = make([]int64, len(ix.keyframes))
+	for _, p := range packets {
+		j := sort.SearchFloat64s(ix.keyframes, p.time)
+		if j == len(ix.keyframes) || ix.keyframes[j] > p.time {
+			j--
+		}
+		ix.intervalBytes[max(j, 0)] += p.size
+	}
+
+	// Scale packet bytes by the source's container overhead (headers, index, padding)
+	ix.overhead = max(float64(sourceInfo.Size())/float64(payload), 1)
+	log.Printf("Read %d keyframes of %s stream %d from the packet index (container overhead %.4f).", len(ix.keyframes), codecType, mainStream, ix.overhead)
+	return ix, nil
+}
+
+// plan divides the keyframe intervals first up to (not including) stop into segments.
+// Each segment takes as many whole intervals as fit under limit bytes, so consecutive
+// segments meet exactly at a keyframe and no frames are duplicated or dropped.
+func (ix *keyframeIndex) plan(first, stop int, limit float64) []mediaSegment {
+	var plan []mediaSegment
+	for first < stop {
+		bytes := ix.intervalBytes[first]
+		last := first + 1
+		for last < stop && ix.estimate(bytes+ix.intervalBytes[last]) <= limit {
+			bytes += ix.intervalBytes[last]
+			last++
+		}
+		if ix.estimate(ix.intervalBytes[first]) > limit {
+			log.Printf("Warning: The keyframe interval at %s alone is about %.2f MB, more than the part size allows.",
+				formatDurationHHMMSSms(ix.keyframes[first]), ix.estimate(ix.intervalBytes[first])/1024/1024)
+		}
+		plan = append(plan, ix.segment(first, last))
+		first = last
+	}
+	return plan
+}
+
+// segment returns the cut covering keyframe intervals first up to (not including) last.
+func (ix *keyframeIndex) segment(first, last int) mediaSegment {
+	start := ix.keyframes[first] + KeyframeCutOffsetSec
+	if first == 0 {
+		start = 0 // Include anything before the first keyframe, such as leading audio
+	}
+	end := ix.endTime + KeyframeCutOffsetSec
+	if last < len(ix.keyframes) {
+		end = ix.keyframes[last] - KeyframeCutOffsetSec
+	}
+	var bytes int64
+	for _, b := range ix.intervalBytes[first:last] {
+		bytes += b
+	}
+	return mediaSegment{Start: start, Duration: end - start, Bytes: int64(ix.estimate(bytes)), First: first, Last: last}
+}
+
+// estimate returns the expected part size for bytes of packet data.
+func (ix *keyframeIndex) estimate(bytes int64) float64 {
+	return float64(bytes) * ix.overhead
+}
+
+// compactFloats removes consecutive duplicates from a sorted slice.
+func compactFloats(values []float64) []float64 {
+	out := values[:0]
+	for i, v := range values {
+		if i == 0 || v != out[len(out)-1] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// splitAtKeyframes cuts sourcePath at the keyframes planned from ix, without
+// re-encoding, reporting strategy in its events. In VideoSplitSegment mode all parts are first written by a single
+// ffmpeg run. A part that still comes out larger than targetPartSize is deleted and
+// its time range re-planned into smaller parts, down to single keyframe intervals.
+// If onPart is non-nil it is called as each part is created.
+func splitAtKeyframes(ctx context.Context, ffmpegPath, sourcePath string, ix *keyframeIndex, targetPartSize int64, mode, strategy string, events *eventStream, onPart partCallback) ([]splitPart, error) {
+	sourceInfo, err := os.Stat(sourcePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file info for %s: %w", sourcePath, err)
+	}
+	sourceDir := filepath.Dir(sourcePath)
+	sourceBaseName := filepath.Base(sourcePath)
+	sourceExt := filepath.Ext(sourceBaseName)
+	sourceNameOnly := strings.TrimSuffix(sourceBaseName, sourceExt)
+
+	limit := float64(targetPartSize) * VideoSizeSafetyFactor
+	pending := ix.plan(0, len(ix.keyframes), limit)
+	log.Printf("Planned %d parts at keyframes of '%s'.", len(pending), sourceBaseName)
+	events.emit(EventSplitStarted, event{File: sourceBaseName, Strategy: strategy, Total: sourceInfo.Size(), Parts: len(pending)})
+
+	if mode == VideoSplitSegment {
+		if onPart != nil {
+			log.Printf("Warning: Single-pass segmenting writes all parts before any is sent. Cutting parts one by one to keep the pipeline's disk bound.")
+		} else if err := segmentVideo(ctx, ffmpegPath, sourcePath, pending); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			log.Printf("Warning: Single-pass segmenting of '%s' failed: %v. Cutting parts one by one.", sourceBaseName, err)
+		}
+	}
+
+	var parts []splitPart
+	created := 0 // Parts produced, including any handed over to onPart
+	// cleanup removes the parts created so far and any segmented files not yet used
+	cleanup := func() {
+		cleanupParts(splitPaths(parts))
+		for _, seg := range pending {
+			if seg.Precut != "" {
+				os.Remove(seg.Precut)
+			}
+		}
+	}
+	for len(pending) > 0 {
+		if err := ctx.Err(); err != nil {
+			cleanup()
+			return nil, err
+		}
+		seg := pending[0]
+		pending = pending[1:]
+		partNum := created + 1
+		partFileName := fmt.Sprintf("%s_part%03d%s", sourceNameOnly, partNum, sourceExt)
+		partFilePath := filepath.Join(sourceDir, partFileName)
+
+		log.Printf("------------------------------------")
+		log.Printf("Part %d: %s to %s (estimated %.2f MB)", partNum,
+			formatDurationHHMMSSms(seg.Start), formatDurationHHMMSSms(seg.Start+seg.Duration), float64(seg.Bytes)/1024/1024)
+
+		if seg.Precut != "" {
+			if err := os.Rename(seg.Precut, partFilePath); err != nil {
+				os.Remove(seg.Precut)
+				cleanup()
+				return nil, fmt.Errorf("failed to rename segment %s: %w", seg.Precut, err)
+			}
+		} else if err := cutVideoSegment(ctx, ffmpegPath, sourcePath, partFilePath, seg.Start, seg.Duration); err != nil {
+			cleanup()
+			return nil, fmt.Errorf("part %d: %w", partNum, err)
+		}
+		partInfo, err := os.Stat(partFilePath)
+		if err != nil {
+			cleanup()
+			return nil, fmt.Errorf("failed to stat created part %d file %s: %w", partNum, partFilePath, err)
+		}
+		log.Printf("Part %d created: %s (Size: %.2f MB)", partNum, partFilePath, float64(partInfo.Size())/1024/1024)
+
+		if partInfo.Size() > targetPartSize {
+			os.Remove(partFilePath)
+			if seg.Last-seg.First <= 1 {
+				cleanup()
+				return nil, fmt.Errorf("part %d (%d bytes) is a single keyframe interval larger than %d bytes and cannot be cut without re-encoding",
+					partNum, partInfo.Size(), targetPartSize)
+			}
+			// The estimate was too low for this stretch; scale the limit by how far off it was
+			sub := ix.plan(seg.First, seg.Last, limit*float64(seg.Bytes)/float64(partInfo.Size()))
+			if len(sub) < 2 {
+				mid := (seg.First + seg.Last) / 2
+				sub = []mediaSegment{ix.segment(seg.First, mid), ix.segment(mid, seg.Last)}
+			}
+			detail := fmt.Sprintf("part %d came out at %d bytes, over the %d byte limit; re-cutting %s to %s into %d parts",
+				partNum, partInfo.Size(), targetPartSize, formatDurationHHMMSSms(seg.Start), formatDurationHHMMSSms(seg.Start+seg.Duration), len(sub))
+			log.Printf("Warning: Part %d size (%d bytes) exceeds target MaxFileSize (%d bytes). Re-cutting %s to %s into %d parts.",
+				partNum, partInfo.Size(), targetPartSize, formatDurationHHMMSSms(seg.Start), formatDurationHHMMSSms(seg.Start+seg.Duration), len(sub))
+			events.emit(EventPartResplit, event{File: partFileName, Part: partNum, Parts: len(sub), Bytes: partInfo.Size(), Total: targetPartSize, Detail: detail})
+			pending = append(sub, pending...)
+			continue
+		}
+
+		part := splitPart{Path: partFilePath, StartS: seg.Start, DurationS: seg.Duration}
+		parts = append(parts, part)
+		created++
+		events.emit(EventPartCreated, event{File: partFileName, Part: partNum, Parts: created + len(pending), Bytes: partInfo.Size()})
+		if onPart != nil {
+			parts = parts[:len(parts)-1] // Handed over to onPart
+			if err := onPart(partNum, part); err != nil {
+				cleanup()
+				return nil, err
+			}
+		}
+	}
+
+	log.Printf("------------------------------------")
+	log.Printf("Finished splitting %s into %d parts at keyframes.", strategy, created)
+	events.emit(EventSplitFinished, event{File: sourceBaseName, Strategy: strategy, Parts: created})
+	return parts, nil
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -21,10 +23,21 @@ import (
 )
 
 const (
-	// MaxFileSize defines the Telegram upload limit threshold (e.g., 1.95 GB)
-	MaxFileSize int64 = 1950 * 1024 * 1024 // 1.95 GB to be safe
+	// BotMaxFileSize is the upload limit of bots and regular accounts (2 GB).
+	BotMaxFileSize int64 = 1950 * 1024 * 1024 // 1.95 GB to be safe
+	// PremiumMaxFileSize is the upload limit of Telegram Premium accounts (4 GB).
+	PremiumMaxFileSize int64 = 3900 * 1024 * 1024 // 3.9 GB to be safe
+)
+
+var (
+	// MaxFileSize defines the Telegram upload limit threshold (e.g., 1.95 GB). It is
+	// raised to PremiumMaxFileSize when uploading as a Premium user account.
+	MaxFileSize int64 = BotMaxFileSize
 	// PartSize defines the target size for *non-video* split parts. Should be <= MaxFileSize.
 	PartSize int64 = MaxFileSize
+)
+
+const (
 	// SafetyFactor for video splitting (e.g., 0.95 means aim for 95% of MaxFileSize)
 	VideoSizeSafetyFactor float64 = 0.95
 	// MinVideoSegmentDurationSec is the minimum duration for a video segment.
@@ -33,162 +46,185 @@ const (
 	MimeDetectBufferSize = 512
 )
 
+// Video split modes accepted by --video-split.
+const (
+	VideoSplitCut     = "cut"     // One ffmpeg run per part, seeking to each cut point
+	VideoSplitSegment = "segment" // One ffmpeg run with the segment muxer, reading the source once
+)
+
 // --- Main Function ---
 
 func main() {
 	godotenv.Load()
-	appIDStr := os.Getenv("API_ID")
-	appHash := os.Getenv("API_HASH")
-	botToken := os.Getenv("BOT_TOKEN")
 
-	appID, err := strconv.Atoi(appIDStr)
-	if err != nil {
-		log.Fatalf("Invalid APP_ID: %v", err)
-	}
-	if len(os.Args) < 3 {
-		log.Fatalf("Usage: %s <chat_id> <file_path>", os.Args[0])
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "serve":
+			runServe(os.Args[2:])
+			return
+		case "download", "join":
+			runDownload(os.Args[2:])
+			return
+		case "keygen":
+			runKeygen(os.Args[2:])
+			return
+		case "login":
+			runLogin(os.Args[2:])
+			return
+		}
 	}
+	runSend(os.Args[1:])
+}
 
-	chatID := os.Args[1]
-	filePath := os.Args[2]
+// runSend uploads a single file and exits. This is the default command.
+func runSend(args []string) {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	outputFormat := fs.String("output", OutputIDs, "Result format written to stdout: 'ids' or 'json'")
+	eventsTarget := fs.String("events", "", "Write NDJSON progress events to 'stderr', 'fd:<n>', 'unix:<socket>' or a file path")
+	pipeline := fs.Int("pipeline", 0, "Upload each part as soon as it is split, keeping at most N parts on disk (0 splits everything first)")
+	parallel := fs.Int("parallel", 1, "Upload the bytes of up to N parts at the same time, still posting them in order")
+	videoSplit := fs.String("video-split", VideoSplitCut, "How video parts are cut: 'cut' runs ffmpeg once per part, 'segment' splits in one sequential read")
+	transcode := fs.Bool("transcode", false, "Re-encode videos that need splitting with libx264/AAC so they fit into --transcode-parts parts")
+	transcodeParts := fs.Int("transcode-parts", 1, "Number of parts to transcode into (with --transcode)")
+	transcodePreset := fs.String("transcode-preset", DefaultTranscodePreset, "libx264 preset for --transcode: "+strings.Join(transcodePresets, ", "))
+	copyParts := fs.Bool("copy-parts", false, "Copy non-video parts into temporary files instead of uploading byte ranges of the source")
+	archive := fs.String("archive", ArchiveNone, "Format of non-video parts: 'none' sends raw byte parts, 'zip' sends volumes of a store-only zip archive that common archivers open")
+	parity := fs.String("parity", "", "Send Reed-Solomon parity parts after non-video parts, as a count ('2') or a percentage of the parts ('10%'), so that as many lost parts can be rebuilt")
+	noManifest := fs.Bool("no-manifest", false, "Do not send a manifest with the original size, checksums and part order after the parts of a split file")
+	encrypt := fs.String("encrypt", EncryptNone, "Encrypt everything sent: 'passphrase' derives the key from $"+PassphraseEnv+", 'recipient' encrypts to the public key given with --recipient")
+	recipient := fs.String("recipient", "", "X25519 public key printed by the keygen command, for --encrypt recipient")
+	compress := fs.String("compress", CompressNone, "Compress files before splitting: 'zstd' compresses unless the file is media or a sample of it does not compress")
+	cachePath := fs.String("cache", DefaultMediaCachePath, "Media cache database; content sent before is sent again by reference instead of uploading it ('' disables the cache)")
+	noCache := fs.Bool("no-cache", false, "Upload everything again, without looking up the media cache (newly sent documents are still cached)")
+	user := fs.Bool("user", false, "Upload as the user account logged in by the login command; Premium accounts send files of up to 3.9 GB without splitting")
+	session := fs.String("session", DefaultUserSession, "Session file of the user account for --user")
+	resume := fs.Bool("resume", false, "Save split progress to '<file_path>"+StateFileSuffix+"' and skip parts already sent by an earlier run")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] <chat_id>[,<chat_id>...] <file_path>\n       %s serve [flags]\n       %s download [flags] <chat_id> <message_ids>\n       %s keygen [-out file]\n       %s login [-session file] [-phone number]\n", os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *outputFormat != OutputIDs && *outputFormat != OutputJSON {
+		log.Fatalf("Invalid --output value '%s': must be '%s' or '%s'", *outputFormat, OutputIDs, OutputJSON)
+	}
+
+	opts := uploadOptions{
+		Pipeline:        *pipeline,
+		Parallel:        *parallel,
+		CopyParts:       *copyParts,
+		VideoSplit:      *videoSplit,
+		Transcode:       *transcode,
+		TranscodeParts:  *transcodeParts,
+		TranscodePreset: *transcodePreset,
+		Archive:         *archive,
+		NoManifest:      *noManifest,
+		Parity:          *parity,
+		Encrypt:         *encrypt,
+		Recipient:       *recipient,
+		Compress:        *compress,
+		NoCache:         *noCache,
+		// The legacy output prints no checksums; progress events carry the full result
+		noPartDigests: *outputFormat == OutputIDs && *eventsTarget == "",
+	}
+	if err := opts.validate(); err != nil {
+		log.Fatalf("Invalid options: %v", err)
+	}
+
+	// The file is uploaded to the first chat and copied by reference to the others
+	destinations := strings.Split(fs.Arg(0), ",")
+	chatID := destinations[0]
+	opts.CopyTo = destinations[1:]
+	if err := validateCopyTo(chatID, opts.CopyTo); err != nil {
+		log.Fatalf("Invalid chat IDs: %v", err)
+	}
+	filePath := fs.Arg(1)
+
+	events, err := openEventStream(*eventsTarget)
+	if err != nil {
+		log.Fatalf("Error opening event stream: %v", err)
+	}
+	defer events.Close()
 
 	// --- Get File Metadata ---
-	fileInfo, err := os.Stat(filePath)
-	if err != nil {
+	if _, err := os.Stat(filePath); err != nil {
 		log.Fatalf("Error getting file metadata for %s: %v", filePath, err)
 	}
-	originalFileName := fileInfo.Name()
-	fileSize := fileInfo.Size()
 
-	// --- Initialize Telegram Client ---
-	client, err := telegram.NewClient(telegram.ClientConfig{
-		AppID:   int32(appID),
-		AppHash: appHash,
-	})
+	client, bots, err := newUploadClient(*user, *session)
 	if err != nil {
-		log.Fatalf("Error creating Telegram client: %v", err)
+		log.Fatalf("%v", err)
 	}
 
-	// Connect and Login
-	_, err = client.Conn()
-	if err != nil {
-		log.Fatalf("Error connecting client: %v", err)
-	}
-	err = client.LoginBot(botToken)
-	if err != nil {
-		log.Fatalf("Error logging in as bot: %v", err)
+	var store stateStore
+	if *resume {
+		store = newFileStateStore(filePath)
 	}
-	log.Println("Telegram client logged in.")
 
-	// --- File Handling Logic ---
-	if fileSize <= MaxFileSize {
-		log.Printf("File '%s' is small enough, sending directly.", originalFileName)
-		id := sendFile(client, chatID, filePath, originalFileName)
-		if id == -1 {
-			log.Fatalf("Failed to send file '%s' to chat '%s'", filePath, chatID)
-		}
-		fmt.Printf("%d", id) // Output single message ID
-	} else {
-		log.Printf("File '%s' is larger than MaxFileSize (%d bytes). Checking type...", originalFileName, MaxFileSize)
+	result := runUpload(context.Background(), client, chatID, filePath, opts, events, store, newMediaCache(*cachePath), bots)
 
-		// --- Detect File Type ---
-		mimeType, err := detectMimeType(filePath)
-		if err != nil {
-			log.Printf("Warning: Could not detect MIME type for %s: %v. Proceeding with generic splitting.", originalFileName, err)
-			mimeType = "application/octet-stream" // Default fallback
-		}
-		log.Printf("Detected MIME type: %s", mimeType)
-
-		var partPaths []string
-		var splitErr error
-		var cleanupPaths []string // Keep track of files to delete
-		isVideo := strings.HasPrefix(mimeType, "video/")
-
-		if isVideo {
-			log.Println("File identified as video. Attempting to split into segments based on size using ffmpeg...")
-			partPaths, splitErr = splitVideoBySize(filePath, MaxFileSize)
-			if splitErr != nil {
-				log.Fatalf("Error splitting video file '%s': %v", filePath, splitErr)
-			}
-			cleanupPaths = partPaths // Video parts are temporary
-			log.Printf("Video split into %d segments.", len(partPaths))
-		} else {
-			log.Println("File is not a video or detection failed. Splitting into generic parts...")
-			partPaths, splitErr = splitGenericFile(filePath, PartSize)
-			if splitErr != nil {
-				log.Fatalf("Error splitting generic file '%s': %v", filePath, splitErr)
-			}
-			cleanupPaths = partPaths // Generic parts are also temporary
-			log.Printf("File split into %d parts.", len(partPaths))
-		}
+	// Output the successful message IDs (or the full result document)
+	if err := writeResult(os.Stdout, result, *outputFormat); err != nil {
+		log.Printf("Warning: Failed to write result: %v", err)
+	}
 
-		// Schedule cleanup for all temporary parts
-		for _, partPath := range cleanupPaths {
-			pathToClean := partPath // Capture loop variable for defer
-			defer func() {
-				log.Printf("Cleaning up temporary part: %s", pathToClean)
-				err := os.Remove(pathToClean)
-				if err != nil && !os.IsNotExist(err) {
-					log.Printf("Warning: Failed to remove temporary part %s: %v", pathToClean, err)
-				}
-			}()
-		}
+	if !result.Success {
+		events.Close()
+		os.Exit(1) // Indicate failure
+	}
+}
 
-		// --- Send Parts ---
-		initialMsg, _ := client.SendMessage(chatID, fmt.Sprintf("Sending '%s' in %d parts...", originalFileName, len(partPaths)))
-		var msgIdArray []int32
-		failed := false
-
-		for i, partPath := range partPaths {
-			partNum := i + 1
-			partFileName := fmt.Sprintf("%s (Part %d/%d)", originalFileName, partNum, len(partPaths))
-			log.Printf("Sending part %d: %s", partNum, partPath)
-
-			// Send the current part
-			id := sendFile(client, chatID, partPath, partFileName)
-			if id != -1 {
-				log.Printf("Sent part %d, message ID: %v", partNum, id)
-				msgIdArray = append(msgIdArray, id)
-			} else {
-				log.Printf("Failed to send part '%s' (part %d) to chat '%s'", partPath, partNum, chatID)
-				failed = true
-				// break // Uncomment to stop after first failure
-			}
-		}
+// newBotClient creates a Telegram client from the environment, connects it and logs in as the bot.
+func newBotClient() (*telegram.Client, error) {
+	return loginBot(os.Getenv("BOT_TOKEN"), "")
+}
 
-		// --- Final Status ---
-		var finalStatusMsg string
-		var outputIds string
+// loginBot creates a Telegram client with the app credentials from the environment,
+// connects it and logs in with botToken. An empty session uses the default session file.
+func loginBot(botToken, session string) (*telegram.Client, error) {
+	client, err := newClient(session)
+	if err != nil {
+		return nil, err
+	}
+	err = client.LoginBot(botToken)
+	if err != nil {
+		return nil, fmt.Errorf("error logging in as bot: %w", err)
+	}
+	log.Println("Telegram client logged in.")
+	return client, nil
+}
 
-		if failed {
-			finalStatusMsg = fmt.Sprintf("Finished sending '%s'. %d parts sent, but some failed.", originalFileName, len(msgIdArray))
-		} else {
-			finalStatusMsg = fmt.Sprintf("Finished sending '%s' in %d parts.", originalFileName, len(partPaths))
-		}
+// newClient creates a Telegram client with the app credentials from the environment
+// and connects it. An empty session uses the default session file.
+func newClient(session string) (*telegram.Client, error) {
+	appIDStr := os.Getenv("API_ID")
+	appHash := os.Getenv("API_HASH")
 
-		if initialMsg != nil {
-			_, err := initialMsg.Edit(finalStatusMsg)
-			if err != nil {
-				log.Printf("Warning: Failed to edit final status message: %v", err)
-				client.SendMessage(chatID, finalStatusMsg)
-			}
-		} else {
-			client.SendMessage(chatID, finalStatusMsg)
-		}
+	appID, err := strconv.Atoi(appIDStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid APP_ID: %w", err)
+	}
 
-		// Output the comma-separated list of successful message IDs
-		for i, id := range msgIdArray {
-			outputIds += fmt.Sprintf("%v", id)
-			if i < len(msgIdArray)-1 {
-				outputIds += ","
-			}
-		}
-		fmt.Printf("%s", outputIds) // Output comma-separated message IDs
+	// --- Initialize Telegram Client ---
+	client, err := telegram.NewClient(telegram.ClientConfig{
+		AppID:   int32(appID),
+		AppHash: appHash,
+		Session: session,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating Telegram client: %w", err)
+	}
 
-		if failed {
-			os.Exit(1) // Indicate failure
-		}
+	// Connect
+	_, err = client.Conn()
+	if err != nil {
+		return nil, fmt.Errorf("error connecting client: %w", err)
 	}
+	return client, nil
 }
 
 // --- Helper Functions ---
@@ -283,6 +319,38 @@ func getVideoDuration(filePath string) (float64, error) {
 	return duration, nil
 }
 
+// getVideoDimensions uses ffprobe to get the width and height of the first video stream of a file.
+func getVideoDimensions(filePath string) (int32, int32, error) {
+	ffprobePath, err := exec.LookPath("ffprobe")
+	if err != nil {
+		return 0, 0, fmt.Errorf("ffprobe not found in PATH: %w", err)
+	}
+	cmd := exec.Command(ffprobePath,
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "stream=width,height",
+		"-of", "json",
+		filePath,
+	)
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return 0, 0, fmt.Errorf("ffprobe failed for %s: %w\nStderr: %s", filePath, err, stderr.String())
+	}
+
+	var probeData struct {
+		Streams []struct {
+			Width  int32 `json:"width"`
+			Height int32 `json:"height"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &probeData); err != nil || len(probeData.Streams) == 0 {
+		return 0, 0, fmt.Errorf("failed to parse ffprobe stream dimensions for %s or no video stream found\nOutput: %s", filePath, out.String())
+	}
+	return probeData.Streams[0].Width, probeData.Streams[0].Height, nil
+}
+
 // formatDuration converts seconds to HH:MM:SS.ms format for ffmpeg -ss
 func formatDurationHHMMSSms(seconds float64) string {
 	if seconds < 0 {
@@ -296,16 +364,52 @@ func formatDurationHHMMSSms(seconds float64) string {
 	return fmt.Sprintf("%02d:%02d:%02d.%03d", hours, minutes, secs, milliseconds)
 }
 
-// splitVideoBySize splits a video iteratively, aiming for size constraints.
-func splitVideoBySize(sourcePath string, targetPartSize int64) ([]string, error) {
+// splitPart is a part file written by a splitter. Video parts also record the
+// time range of the source they were cut from, so that a missing part can be
+// cut again exactly as before.
+type splitPart struct {
+	Path      string
+	StartS    float64
+	DurationS float64
+}
+
+// partCallback is invoked by the splitters after each part has been written, so that
+// a pipelined upload can consume parts while later ones are still being produced.
+// The callback takes ownership of the part file, which the splitter then neither
+// returns nor cleans up. Returning an error aborts the split.
+type partCallback func(partNum int, part splitPart) error
+
+// splitVideoBySize splits a video into parts of at most targetPartSize bytes, with
+// cut points planned from the keyframe index read by ffprobe. mode is one of the
+// VideoSplit* constants; an empty mode means VideoSplitCut.
+// If onPart is non-nil it is called as each part is created.
+func splitVideoBySize(ctx context.Context, sourcePath string, targetPartSize int64, mode string, events *eventStream, onPart partCallback) ([]splitPart, error) {
 	ffmpegPath, err := exec.LookPath("ffmpeg")
 	if err != nil {
 		return nil, fmt.Errorf("ffmpeg not found in PATH: %w. Please install ffmpeg", err)
 	}
-	if _, err := exec.LookPath("ffprobe"); err != nil {
+	ffprobePath, err := exec.LookPath("ffprobe")
+	if err != nil {
 		return nil, fmt.Errorf("ffprobe not found in PATH: %w. Please install ffprobe", err)
 	}
 
+	index, err := probeKeyframeIndex(ctx, ffprobePath, sourcePath, "video")
+	if err != nil {
+		return nil, fmt.Errorf("could not read the keyframe index of %s: %w", sourcePath, err)
+	}
+	return splitAtKeyframes(ctx, ffmpegPath, sourcePath, index, targetPartSize, mode, StrategyVideo, events, onPart)
+}
+
+// splitVideoByBitrate splits a video (or audio file, with strategy StrategyAudio)
+// iteratively, estimating each segment's length from the average bitrate and
+// advancing by the duration of the part actually created. It needs no packet
+// index, only the container duration.
+// If onPart is non-nil it is called as each part is created.
+func splitVideoByBitrate(ctx context.Context, sourcePath string, targetPartSize int64, strategy string, events *eventStream, onPart partCallback) ([]splitPart, error) {
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg not found in PATH: %w. Please install ffmpeg", err)
+	}
 	sourceInfo, err := os.Stat(sourcePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get file info for %s: %w", sourcePath, err)
@@ -341,15 +445,25 @@ func splitVideoBySize(sourcePath string, targetPartSize int64) ([]string, error)
 	log.Printf("Total duration: %.3fs, Total size: %d bytes", totalDuration, totalSize)
 	log.Printf("Average bitrate: %.2f bytes/sec", averageBytesPerSecond)
 	log.Printf("Targeting segment duration estimate: %.3fs (based on %.2f MB target size)", estimatedDurationPerSegment, effectiveTargetSize/1024/1024)
+	events.emit(EventSplitStarted, event{File: sourceBaseName, Strategy: strategy, Total: totalSize})
 
-	var partPaths []string
+	var parts []splitPart
+	created := 0 // Parts produced, including any handed over to onPart
 	startTime := 0.0
 	partNum := 1
+	retryDuration := 0.0 // Shortened target duration while re-cutting an oversized part
 
 	for startTime < totalDuration {
+		if err := ctx.Err(); err != nil {
+			cleanupParts(splitPaths(parts))
+			return nil, err
+		}
 		// Ensure we don't try to read past the actual end of the video
 		remainingDuration := totalDuration - startTime
 		currentSegmentTargetDuration := math.Min(estimatedDurationPerSegment, remainingDuration)
+		if retryDuration > 0 {
+			currentSegmentTargetDuration = math.Min(retryDuration, remainingDuration)
+		}
 
 		// Prevent creating tiny segments at the end if estimate is large
 		if remainingDuration < MinVideoSegmentDurationSec && remainingDuration > 0 {
@@ -363,43 +477,13 @@ func splitVideoBySize(sourcePath string, targetPartSize int64) ([]string, error)
 		partFileName := fmt.Sprintf("%s_part%03d%s", sourceNameOnly, partNum, sourceExt)
 		partFilePath := filepath.Join(sourceDir, partFileName)
 
-		// Format times for ffmpeg command
-		startTimeFormatted := formatDurationHHMMSSms(startTime)
-		// -t takes duration in seconds
-		durationFormatted := strconv.FormatFloat(currentSegmentTargetDuration, 'f', 3, 64) // 3 decimal places precision
-
 		log.Printf("------------------------------------")
 		log.Printf("Part %d: Start time: %.3fs, Target duration: %.3fs", partNum, startTime, currentSegmentTargetDuration)
 
-		cmdArgs := []string{
-			"-v", "error",
-			"-ss", startTimeFormatted, // Seek *before* input for speed
-			"-i", sourcePath,
-			"-t", durationFormatted, // Duration to copy *from* the seek point
-			"-c", "copy", // Copy streams without re-encoding
-			"-map", "0", // Map all streams
-			// "-avoid_negative_ts", "disabled", // Try replacing this
-			// "-copyts", // Often used with disabled, maybe remove when using make_non_negative
-			"-avoid_negative_ts", "make_non_negative", // More robust timestamp handling for cuts
-			"-movflags", "+faststart", // Good practice for MP4 (harmless for MKV usually)
-			partFilePath,
-		}
-		cmd := exec.Command(ffmpegPath, cmdArgs...)
-
-		var stderr bytes.Buffer
-		cmd.Stderr = &stderr
-
-		log.Printf("Running ffmpeg for part %d: %s", partNum, cmd.String())
-		err = cmd.Run()
-
-		ffmpegStderr := stderr.String()
-		if err != nil {
-			// Cleanup the potentially incomplete part file
-			os.Remove(partFilePath)
+		if err := cutVideoSegment(ctx, ffmpegPath, sourcePath, partFilePath, startTime, currentSegmentTargetDuration); err != nil {
 			// Attempt to delete previously created parts as well
-			cleanupParts(partPaths)
-			return nil, fmt.Errorf("ffmpeg execution failed for part %d (start %.3fs, duration %.3fs): %w\nStderr: %s",
-				partNum, startTime, currentSegmentTargetDuration, err, ffmpegStderr)
+			cleanupParts(splitPaths(parts))
+			return nil, fmt.Errorf("part %d: %w", partNum, err)
 		}
 
 		// Check if the output file was actually created and has size
@@ -410,7 +494,7 @@ func splitVideoBySize(sourcePath string, targetPartSize int64) ([]string, error)
 				log.Printf("Warning: ffmpeg ran for part %d but output file %s not found. Assuming end of video.", partNum, partFilePath)
 				break // Stop processing if no file was created
 			}
-			cleanupParts(partPaths) // Cleanup previous parts on other stat errors
+			cleanupParts(splitPaths(parts)) // Cleanup previous parts on other stat errors
 			return nil, fmt.Errorf("failed to stat created part %d file %s: %w", partNum, partFilePath, err)
 		}
 
@@ -426,14 +510,23 @@ func splitVideoBySize(sourcePath string, targetPartSize int64) ([]string, error)
 			log.Printf("Warning: Could not get duration of created part %d (%s): %v. Cannot reliably continue.", partNum, partFilePath, err)
 			// Decide whether to stop or try to continue with estimate (risky)
 			// Safest is to stop and let user know.
-			cleanupParts(append(partPaths, partFilePath)) // Cleanup everything including current part
+			cleanupParts(append(splitPaths(parts), partFilePath)) // Cleanup everything including current part
 			return nil, fmt.Errorf("failed to get duration of created part %d, cannot continue accurately", partNum)
 		}
 
 		if actualSegmentDuration <= 0 {
 			log.Printf("Warning: Created part %d (%s) reported duration %.3fs. Stopping.", partNum, partFilePath, actualSegmentDuration)
 			// Keep the part? Maybe, if it has size. But advancing startTime is problematic.
-			partPaths = append(partPaths, partFilePath) // Add it, but we can't continue
+			part := splitPart{Path: partFilePath, StartS: startTime, DurationS: currentSegmentTargetDuration}
+			parts = append(parts, part) // Add it, but we can't continue
+			created++
+			if onPart != nil {
+				parts = parts[:len(parts)-1] // Handed over to onPart
+				if err := onPart(partNum, part); err != nil {
+					cleanupParts(splitPaths(parts))
+					return nil, err
+				}
+			}
 			break
 		}
 
@@ -441,33 +534,95 @@ func splitVideoBySize(sourcePath string, targetPartSize int64) ([]string, error)
 			partNum, partFilePath, float64(partInfo.Size())/1024/1024, actualSegmentDuration)
 
 		// Check if the created part exceeds the *original* target size (not the safety-factored one)
+		// If it does, cut the same start again with a duration scaled down by how far over it was.
 		if partInfo.Size() > targetPartSize {
-			log.Printf("Warning: Part %d size (%d bytes) exceeds target MaxFileSize (%d bytes). Input video bitrate likely fluctuates significantly.",
-				partNum, partInfo.Size(), targetPartSize)
-			// Continue anyway, but the user is warned.
+			os.Remove(partFilePath)
+			shortened := currentSegmentTargetDuration * effectiveTargetSize / float64(partInfo.Size())
+			if shortened < MinVideoSegmentDurationSec {
+				cleanupParts(splitPaths(parts))
+				return nil, fmt.Errorf("part %d is %d bytes even at %.3fs and cannot be cut below %d bytes without re-encoding",
+					partNum, partInfo.Size(), currentSegmentTargetDuration, targetPartSize)
+			}
+			log.Printf("Warning: Part %d size (%d bytes) exceeds target MaxFileSize (%d bytes). Input video bitrate likely fluctuates significantly. Re-cutting it with a target duration of %.3fs.",
+				partNum, partInfo.Size(), targetPartSize, shortened)
+			events.emit(EventPartResplit, event{File: partFileName, Part: partNum, Bytes: partInfo.Size(), Total: targetPartSize,
+				Detail: fmt.Sprintf("part %d came out at %d bytes, over the %d byte limit; re-cutting from %.3fs with %.3fs instead of %.3fs",
+					partNum, partInfo.Size(), targetPartSize, startTime, shortened, currentSegmentTargetDuration)})
+			retryDuration = shortened
+			continue
+		}
+		retryDuration = 0
+
+		part := splitPart{Path: partFilePath, StartS: startTime, DurationS: actualSegmentDuration}
+		parts = append(parts, part)
+		created++
+		events.emit(EventPartCreated, event{File: partFileName, Part: partNum, Bytes: partInfo.Size()})
+		if onPart != nil {
+			parts = parts[:len(parts)-1] // Handed over to onPart
+			if err := onPart(partNum, part); err != nil {
+				cleanupParts(splitPaths(parts))
+				return nil, err
+			}
 		}
 
-		partPaths = append(partPaths, partFilePath)
-
 		// Update start time for the next segment using the *actual* duration
 		startTime += actualSegmentDuration
 		partNum++
 
 		// Small safeguard against infinite loops if durations are weirdly reported
 		if partNum > 1000 { // Arbitrary limit
-			cleanupParts(partPaths)
+			cleanupParts(splitPaths(parts))
 			return nil, fmt.Errorf("potential infinite loop detected after 1000 parts, stopping")
 		}
 	}
 
 	log.Printf("------------------------------------")
-	log.Printf("Finished splitting video into %d parts.", len(partPaths))
-	return partPaths, nil
+	log.Printf("Finished splitting video into %d parts.", created)
+	events.emit(EventSplitFinished, event{File: sourceBaseName, Strategy: strategy, Parts: created})
+	return parts, nil
+}
+
+// cutVideoSegment copies duration seconds of sourcePath, starting at startTime, into
+// partFilePath without re-encoding. The partial output is removed on failure.
+func cutVideoSegment(ctx context.Context, ffmpegPath, sourcePath, partFilePath string, startTime, duration float64) error {
+	// Format times for ffmpeg command. Microsecond precision keeps seeks to a planned
+	// keyframe from landing on the one before it.
+	startTimeFormatted := strconv.FormatFloat(startTime, 'f', 6, 64)
+	// -t takes duration in seconds
+	durationFormatted := strconv.FormatFloat(duration, 'f', 6, 64)
+
+	cmdArgs := []string{
+		"-v", "error",
+		"-ss", startTimeFormatted, // Seek *before* input for speed
+		"-i", sourcePath,
+		"-t", durationFormatted, // Duration to copy *from* the seek point
+		"-c", "copy", // Copy streams without re-encoding
+		"-map", "0", // Map all streams
+		// "-avoid_negative_ts", "disabled", // Try replacing this
+		// "-copyts", // Often used with disabled, maybe remove when using make_non_negative
+		"-avoid_negative_ts", "make_non_negative", // More robust timestamp handling for cuts
+		"-movflags", "+faststart", // Good practice for MP4 (harmless for MKV usually)
+		"-y", // Overwrite a stale part left by an earlier run
+		partFilePath,
+	}
+	cmd := exec.CommandContext(ctx, ffmpegPath, cmdArgs...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	log.Printf("Running ffmpeg: %s", cmd.String())
+	if err := cmd.Run(); err != nil {
+		// Cleanup the potentially incomplete part file
+		os.Remove(partFilePath)
+		return fmt.Errorf("ffmpeg execution failed (start %.3fs, duration %.3fs): %w\nStderr: %s",
+			startTime, duration, err, stderr.String())
+	}
+	return nil
 }
 
 // splitGenericFile splits a file into raw byte parts of partSize bytes.
-// (Implementation remains the same as before)
-func splitGenericFile(sourcePath string, partSize int64) ([]string, error) {
+// If onPart is non-nil it is called as each part is created.
+func splitGenericFile(ctx context.Context, sourcePath string, partSize int64, events *eventStream, onPart partCallback) ([]splitPart, error) {
 	if partSize <= 0 {
 		return nil, fmt.Errorf("part size must be positive")
 	}
@@ -484,8 +639,10 @@ func splitGenericFile(sourcePath string, partSize int64) ([]string, error) {
 	}
 	sourceBaseName := sourceInfo.Name()
 	sourceDir := filepath.Dir(sourcePath)
+	events.emit(EventSplitStarted, event{File: sourceBaseName, Strategy: StrategyGeneric, Total: sourceInfo.Size()})
 
 	var partPaths []string
+	created := 0 // Parts produced, including any handed over to onPart
 	partNum := 1
 	reader := bufio.NewReader(sourceFile)
 	// Increase buffer size potentially for larger reads, though LimitedReader caps it
@@ -494,6 +651,10 @@ func splitGenericFile(sourcePath string, partSize int64) ([]string, error) {
 	totalBytesRead := int64(0)
 
 	for {
+		if err := ctx.Err(); err != nil {
+			cleanupParts(partPaths)
+			return nil, err
+		}
 		partFileName := fmt.Sprintf("%s.part%03d", sourceBaseName, partNum)
 		partFilePath := filepath.Join(sourceDir, partFileName)
 
@@ -531,7 +692,16 @@ func splitGenericFile(sourcePath string, partSize int64) ([]string, error) {
 		// Check if any bytes were written. Don't add zero-byte parts unless original file is 0 bytes.
 		if bytesWritten > 0 {
 			partPaths = append(partPaths, partFilePath)
+			created++
 			totalBytesRead += bytesWritten
+			events.emit(EventPartCreated, event{File: partFileName, Part: partNum, Bytes: bytesWritten})
+			if onPart != nil {
+				partPaths = partPaths[:len(partPaths)-1] // Handed over to onPart
+				if err := onPart(partNum, splitPart{Path: partFilePath}); err != nil {
+					cleanupParts(partPaths)
+					return nil, err
+				}
+			}
 		} else {
 			// No bytes written means we likely hit EOF immediately
 			log.Printf("No bytes written for part %d (%s), likely EOF reached. Removing empty part.", partNum, partFilePath)
@@ -540,8 +710,9 @@ func splitGenericFile(sourcePath string, partSize int64) ([]string, error) {
 		}
 
 		// Determine if we should continue. We stop if the CopyBuffer error was EOF,
-		// or if the limitedReader shows N == 0 (meaning it hit EOF before the limit)
-		if err == io.EOF || limitedReader.N == 0 {
+		// or if the part came up short of partSize (the source ended before the limit).
+		// limitedReader.N == 0 only means this part is full, not that the source is exhausted.
+		if err == io.EOF || limitedReader.N > 0 {
 			log.Printf("EOF reached while writing part %d.", partNum)
 			break
 		}
@@ -550,16 +721,58 @@ func splitGenericFile(sourcePath string, partSize int64) ([]string, error) {
 	}
 
 	// Final check: if source was > 0 bytes but no parts were made, something is wrong
-	if len(partPaths) == 0 && sourceInfo.Size() > 0 {
+	if totalBytesRead == 0 && sourceInfo.Size() > 0 {
 		return nil, fmt.Errorf("no parts created for non-empty file %s (size: %d)", sourcePath, sourceInfo.Size())
 	}
-	if len(partPaths) == 0 && sourceInfo.Size() == 0 {
+	if created == 0 && sourceInfo.Size() == 0 {
 		log.Printf("Source file %s is empty, no parts created.", sourcePath)
 		// Return empty slice is correct for empty file
 	}
 
-	log.Printf("Successfully created %d generic parts.", len(partPaths))
-	return partPaths, nil // Success
+	log.Printf("Successfully created %d generic parts.", created)
+	events.emit(EventSplitFinished, event{File: sourceBaseName, Strategy: StrategyGeneric, Parts: created})
+	parts := make([]splitPart, len(partPaths))
+	for i, p := range partPaths {
+		parts[i] = splitPart{Path: p}
+	}
+	return parts, nil // Success
+}
+
+// writeGenericPart copies size bytes of sourcePath, starting at offset, into partPath.
+// It rebuilds a single part exactly as splitGenericFile would have produced it.
+func writeGenericPart(sourcePath, partPath string, offset, size int64) error {
+	sourceFile, err := os.Open(sourcePath)
+	if err != nil {
+		return fmt.Errorf("failed to open source file %s: %w", sourcePath, err)
+	}
+	defer sourceFile.Close()
+
+	partFile, err := os.Create(partPath)
+	if err != nil {
+		return fmt.Errorf("failed to create part file %s: %w", partPath, err)
+	}
+	written, err := io.Copy(partFile, io.NewSectionReader(sourceFile, offset, size))
+	closeErr := partFile.Close()
+	if err == nil && written != size {
+		err = fmt.Errorf("source ended after %d of %d bytes", written, size)
+	}
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(partPath)
+		return fmt.Errorf("error writing part %s: %w", partPath, err)
+	}
+	return nil
+}
+
+// splitPaths returns the file paths of split parts.
+func splitPaths(parts []splitPart) []string {
+	paths := make([]string, len(parts))
+	for i, p := range parts {
+		paths[i] = p.Path
+	}
+	return paths
 }
 
 // cleanupParts removes a list of temporary part files.
@@ -573,17 +786,39 @@ func cleanupParts(paths []string) {
 	}
 }
 
-// sendFile handles sending a single file (or part) with progress and flood handling
-// (Implementation remains the same as before)
-func sendFile(client *telegram.Client, chatID, filePath, captionFileName string) int32 {
+// sendFile handles sending a single file (or part) with progress and flood handling.
+// The returned partResult has MessageID -1 and Error set on failure.
+func sendFile(client *telegram.Client, chatID, filePath, captionFileName string, partNum int, events *eventStream, maxWait time.Duration) partResult {
+	part := partResult{Index: partNum, MessageID: -1, FileName: captionFileName}
+
 	metadata, err := os.Stat(filePath)
 	if err != nil {
 		log.Printf("Error stating file %s for sending: %v", filePath, err)
 		client.SendMessage(chatID, fmt.Sprintf("Error preparing to send %s: %v", captionFileName, err))
-		return -1
+		part.Error = err.Error()
+		return part
 	}
 
-	progressCaption := fmt.Sprintf("⬆️ Sending: %s (%.2f MB)", captionFileName, float64(metadata.Size())/1024/1024)
+	return sendMedia(client, chatID, captionFileName, metadata.Size(), partNum, events, maxWait, func(onProgress func(totalSize, currentSize int64)) (*telegram.NewMessage, error) {
+		return client.SendMedia(chatID, filePath, &telegram.MediaOptions{
+			// Update progress less frequently if needed (e.g., every 5%)
+			ProgressManager: telegram.NewProgressManager(5, onProgress),
+			FileName:        captionFileName,
+		})
+	})
+}
+
+// mediaUploader uploads and sends one piece of media, reporting progress through onProgress.
+// sendMedia calls it again to retry after a flood wait.
+type mediaUploader func(onProgress func(totalSize, currentSize int64)) (*telegram.NewMessage, error)
+
+// sendMedia wraps an upload of size bytes with a progress status message, progress
+// events and flood-wait handling. The returned partResult has MessageID -1 and
+// Error set on failure.
+func sendMedia(client *telegram.Client, chatID, captionFileName string, size int64, partNum int, events *eventStream, maxWait time.Duration, upload mediaUploader) partResult {
+	part := partResult{Index: partNum, MessageID: -1, FileName: captionFileName, Size: size}
+
+	progressCaption := fmt.Sprintf("⬆️ Sending: %s (%.2f MB)", captionFileName, float64(size)/1024/1024)
 	msg, err := client.SendMessage(chatID, progressCaption)
 	if err != nil {
 		log.Printf("Warning: Could not send initial status message for %s: %v", captionFileName, err)
@@ -591,12 +826,21 @@ func sendFile(client *telegram.Client, chatID, filePath, captionFileName string)
 	}
 
 	var lastProgress int = -1
-	// Update progress less frequently if needed (e.g., every 5%)
-	pm := telegram.NewProgressManager(5, func(totalSize, currentSize int64) {
+	startTime := time.Now()
+	onProgress := func(totalSize, currentSize int64) {
 		if totalSize == 0 {
 			return
 		}
-		progress := int(float64(currentSize) / float64(totalSize) * 100)
+		percent := float64(currentSize) / float64(totalSize) * 100
+		events.emit(EventUploadProgress, event{
+			File:     captionFileName,
+			Part:     partNum,
+			Bytes:    currentSize,
+			Total:    totalSize,
+			Percent:  percent,
+			SpeedBps: float64(currentSize) / time.Since(startTime).Seconds(),
+		})
+		progress := int(percent)
 		// Update only on significant progress change to reduce API calls
 		if progress != lastProgress && progress%5 == 0 && msg != nil {
 			_, err := msg.Edit(fmt.Sprintf("⬆️ Sending: %s (%.2f/%.2f MB) %d%%",
@@ -605,33 +849,32 @@ func sendFile(client *telegram.Client, chatID, filePath, captionFileName string)
 				float64(totalSize)/1024/1024,
 				progress))
 			if err != nil {
-				if !handleIfFlood(err) {
+				if !handleIfFlood(err, events) {
 					log.Printf("Warning: Could not update progress message for %s: %v", captionFileName, err)
 				}
 			}
 			lastProgress = progress
 		}
-	})
-
-	mediaOptions := &telegram.MediaOptions{
-		ProgressManager: pm,
-		FileName:        captionFileName,
 	}
 
-	startTime := time.Now()
+	startTime = time.Now()
 	log.Printf("Starting upload for: %s", captionFileName)
-	result, err := client.SendMedia(chatID, filePath, mediaOptions)
+	events.emit(EventUploadStarted, event{File: captionFileName, Part: partNum, Total: size})
+	result, err := upload(onProgress)
 	uploadDuration := time.Since(startTime)
+	part.UploadS = uploadDuration.Seconds()
 
 	deleteProgressMsg := true
 
 	if err != nil {
 		log.Printf("Error sending %s: %v", captionFileName, err)
-		if handleIfFlood(err) {
+		if handleIfFloodWithin(err, events, maxWait) {
 			log.Printf("Flood wait detected and handled for %s. Retrying...", captionFileName)
+			events.emit(EventRetry, event{File: captionFileName, Part: partNum, Attempt: 2, Error: err.Error()})
 			err = nil // Clear error for retry
-			result, err = client.SendMedia(chatID, filePath, mediaOptions)
+			result, err = upload(onProgress)
 			uploadDuration = time.Since(startTime) // Recalculate duration
+			part.UploadS = uploadDuration.Seconds()
 		}
 
 		if err != nil {
@@ -643,12 +886,14 @@ func sendFile(client *telegram.Client, chatID, filePath, captionFileName string)
 			} else {
 				client.SendMessage(chatID, errMsg)
 			}
-			return -1
+			part.Error = err.Error()
+			events.emit(EventPartFinished, event{File: captionFileName, Part: partNum, Error: part.Error})
+			return part
 		}
 		log.Printf("Retry successful for %s.", captionFileName)
 	}
 
-	successMsg := fmt.Sprintf("✅ Sent: %s (%.2f MB) in %.2f s", captionFileName, float64(metadata.Size())/1024/1024, uploadDuration.Seconds())
+	successMsg := fmt.Sprintf("✅ Sent: %s (%.2f MB) in %.2f s", captionFileName, float64(size)/1024/1024, uploadDuration.Seconds())
 	log.Println(successMsg)
 
 	if msg != nil && deleteProgressMsg {
@@ -671,63 +916,83 @@ func sendFile(client *telegram.Client, chatID, filePath, captionFileName string)
 	}
 
 	if result != nil {
-		return result.ID
+		part.MessageID = result.ID
+		part.document = documentOf(result)
+	} else {
+		log.Printf("Error: SendMedia returned nil result despite no error for %s", captionFileName)
+		part.Error = "SendMedia returned nil result"
 	}
-	log.Printf("Error: SendMedia returned nil result despite no error for %s", captionFileName)
-	return -1
+	events.emit(EventPartFinished, event{File: captionFileName, Part: partNum, MessageID: part.MessageID, Bytes: part.Size, Error: part.Error})
+	return part
 }
 
 // handleIfFlood checks for Telegram flood wait errors and sleeps accordingly.
-// (Implementation remains the same as before)
-func handleIfFlood(err error) bool {
+func handleIfFlood(err error, events *eventStream) bool {
+	return handleIfFloodWithin(err, events, 0)
+}
+
+// handleIfFloodWithin is handleIfFlood for requests that someone else can take over:
+// waits longer than maxWait are not slept through and report false. A zero maxWait
+// sleeps through any wait.
+func handleIfFloodWithin(err error, events *eventStream, maxWait time.Duration) bool {
 	if err == nil {
 		return false
 	}
+	errMsg := err.Error()
+	sleepDuration, isFlood := floodWait(errMsg)
+	if !isFlood {
+		return false
+	}
+
+	if maxWait > 0 && sleepDuration > maxWait {
+		log.Printf("Flood wait of %v is longer than %v; leaving the request to another bot.", sleepDuration, maxWait)
+		return false
+	}
+	if sleepDuration == 0 {
+		// Fallback sleep
+		log.Printf("Flood wait detected (parsing failed), sleeping for %v fallback...", DefaultFloodWait)
+		sleepDuration = DefaultFloodWait
+	} else {
+		log.Printf("Flood wait encountered: Waiting for %v...", sleepDuration)
+	}
+	events.emit(EventFloodWait, event{WaitS: sleepDuration.Seconds(), Error: errMsg})
+	time.Sleep(sleepDuration)
+	return true
+}
 
+// floodWait reports whether errMsg is a Telegram flood wait error and how long it asks
+// to wait, with a small buffer added. The wait is zero if it could not be parsed.
+func floodWait(errMsg string) (time.Duration, bool) {
 	waitMatch := "FLOOD_WAIT_"
 	premiumWaitMatch := "FLOOD_PREMIUM_WAIT_"
-	errMsg := err.Error()
 
-	isFlood := false
 	waitPrefix := ""
-
 	if strings.Contains(errMsg, waitMatch) {
-		isFlood = true
 		waitPrefix = waitMatch
 	} else if strings.Contains(errMsg, premiumWaitMatch) {
-		isFlood = true
 		waitPrefix = premiumWaitMatch
+	} else {
+		return 0, false
 	}
 
-	if isFlood {
-		parts := strings.Split(errMsg, waitPrefix)
-		if len(parts) > 1 {
-			waitValStr := strings.TrimSpace(parts[1])
-			numericPart := ""
-			for _, r := range waitValStr {
-				if r >= '0' && r <= '9' {
-					numericPart += string(r)
-				} else {
-					break
-				}
-			}
-
-			if waitVal, convErr := strconv.ParseInt(numericPart, 10, 64); convErr == nil && waitVal > 0 {
-				sleepDuration := time.Duration(waitVal+2) * time.Second // Add buffer
-				log.Printf("Flood wait encountered: Waiting for %v...", sleepDuration)
-				time.Sleep(sleepDuration)
-				return true
-			} else {
-				log.Printf("Warning: Could not parse flood wait time from error: %s (parsed: '%s')", errMsg, numericPart)
-			}
+	parts := strings.Split(errMsg, waitPrefix)
+	if len(parts) < 2 {
+		log.Printf("Warning: Could not extract wait time from flood error: %s", errMsg)
+		return 0, true
+	}
+	waitValStr := strings.TrimSpace(parts[1])
+	numericPart := ""
+	for _, r := range waitValStr {
+		if r >= '0' && r <= '9' {
+			numericPart += string(r)
 		} else {
-			log.Printf("Warning: Could not extract wait time from flood error: %s", errMsg)
+			break
 		}
-		// Fallback sleep
-		log.Printf("Flood wait detected (parsing failed), sleeping for 15s fallback...")
-		time.Sleep(15 * time.Second)
-		return true
 	}
-
-	return false
+	waitVal, convErr := strconv.ParseInt(numericPart, 10, 64)
+	if convErr != nil || waitVal <= 0 {
+		log.Printf("Warning: Could not parse flood wait time from error: %s (parsed: '%s')", errMsg, numericPart)
+		return 0, true
+	}
+	return time.Duration(waitVal+2) * time.Second, true // Add buffer
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/amarnathcjd/gogram/telegram"
+)
+
+const (
+	// ManifestSuffix is appended to the file name to name the manifest document.
+	ManifestSuffix = ".manifest.json"
+	// ManifestVersion is the version of the manifest format written by this build.
+	ManifestVersion = 1
+)
+
+// manifest describes a split upload so that missing or corrupted parts can be detected
+// and the original file verified after joining. It is sent after the last part.
+type manifest struct {
+	Version     int              `json:"version"`
+	FileName    string           `json:"file_name"`
+	FileSize    int64            `json:"file_size"`
+	SHA256      string           `json:"sha256"`
+	MimeType    string           `json:"mime_type,omitempty"`
+	Strategy    string           `json:"strategy"` // One of the Strategy* constants
+	Parts       []manifestPart   `json:"parts"`
+	Parity      *parityInfo      `json:"parity,omitempty"`
+	Encryption  *encryptionInfo  `json:"encryption,omitempty"`  // Parts, parity parts and the manifest itself are sealed
+	Compression *compressionInfo `json:"compression,omitempty"` // The parts make up a compressed copy of the file
+	CreatedAt   time.Time        `json:"created_at"`
+}
+
+// manifestPart is one part of a manifest, in order.
+type manifestPart struct {
+	Index     int     `json:"index"` // 1-based part number
+	MessageID int32   `json:"message_id"`
+	FileName  string  `json:"file_name"`
+	Size      int64   `json:"size"`
+	SHA256    string  `json:"sha256"`
+	StartS    float64 `json:"start_seconds,omitempty"`    // Video and audio parts: offset into the source
+	DurationS float64 `json:"duration_seconds,omitempty"` // Video and audio parts: segment length
+}
+
+// buildManifest describes the sent parts of the upload, hashing the source file.
+func (s *partSender) buildManifest() (*manifest, error) {
+	sum, err := fileSHA256(s.state.Source)
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{
+		Version:     ManifestVersion,
+		FileName:    s.result.FileName,
+		FileSize:    s.state.SourceSize,
+		SHA256:      sum,
+		MimeType:    s.result.MimeType,
+		Strategy:    s.state.Strategy,
+		Parity:      s.result.Parity,
+		Encryption:  s.result.Encryption,
+		Compression: s.result.Compression,
+		CreatedAt:   time.Now().UTC(),
+	}
+	for i, p := range s.state.Parts {
+		part := manifestPart{
+			Index:     p.Index,
+			MessageID: p.MessageID,
+			Size:      p.Size,
+			SHA256:    p.SHA256,
+			StartS:    p.StartS,
+			DurationS: p.DurationS,
+		}
+		if i < len(s.result.Parts) {
+			part.FileName = s.result.Parts[i].FileName // The name shown in Telegram
+		}
+		m.Parts = append(m.Parts, part)
+	}
+	return m, nil
+}
+
+// sendManifest builds the manifest of a completed split upload and sends it as a
+// document after the last part, sealed like the parts if the upload is encrypted.
+// The original file's checksum and the manifest's message ID are recorded in the result.
+func (s *partSender) sendManifest() error {
+	m, err := s.buildManifest()
+	if err != nil {
+		return fmt.Errorf("could not build manifest: %w", err)
+	}
+	s.result.SHA256 = m.SHA256
+
+	log.Printf("Sending manifest of '%s' (%d parts, SHA-256 %s).", s.name, len(m.Parts), m.SHA256)
+	msgID, err := sendManifestDocument(s.client, s.chatID, m, s.sealer, s.events)
+	if err != nil {
+		return err
+	}
+	s.result.ManifestMessageID = msgID
+	s.result.manifest = m
+	return nil
+}
+
+// sendManifestDocument writes m to a temporary file and sends it to chatID, sealed
+// with sl if it is non-nil, returning the message ID.
+func sendManifestDocument(client *telegram.Client, chatID string, m *manifest, sl *sealer, events *eventStream) (int32, error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return 0, fmt.Errorf("could not encode manifest: %w", err)
+	}
+	f, err := os.CreateTemp("", "*"+ManifestSuffix)
+	if err != nil {
+		return 0, fmt.Errorf("could not create manifest file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(append(data, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not write manifest file: %w", err)
+	}
+
+	var part partResult
+	if sl != nil {
+		part = sendSealed(client, chatID, sl, f.Name(), 0, -1, manifestName(m.FileName, sl), 0, events, 0)
+	} else {
+		part = sendFile(client, chatID, f.Name(), manifestName(m.FileName, sl), 0, events, 0)
+	}
+	if part.Error != "" {
+		return 0, fmt.Errorf("could not send manifest: %s", part.Error)
+	}
+	return part.MessageID, nil
+}
+
+// manifestName returns the name of the manifest document of fileName in Telegram.
+func manifestName(fileName string, sl *sealer) string {
+	if sl != nil {
+		return fileName + ManifestSuffix + EncryptedSuffix
+	}
+	return fileName + ManifestSuffix
+}
+
+// readManifest reads a manifest written by sendManifest, decrypting it with keys if it is sealed.
+func readManifest(path string, keys *decryptionKeys) (*manifest, error) {
+	data, err := readMaybeSealed(path, keys)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest %s: %w", path, err)
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("error parsing manifest %s: %w", path, err)
+	}
+	if m.Version > ManifestVersion {
+		return nil, fmt.Errorf("manifest %s has version %d; this build reads up to version %d", path, m.Version, ManifestVersion)
+	}
+	return &m, nil
+}
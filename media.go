@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// MinProbeScore is the lowest ffprobe probe score trusted for a file that neither its
+// content nor its extension marks as media. Lower scores are guesses on arbitrary data.
+const MinProbeScore = 51
+
+// Layers of the media classifier, recorded in mediaInfo.DetectedBy.
+const (
+	DetectedBySniff     = "sniff"
+	DetectedByExtension = "extension"
+	DetectedByFFprobe   = "ffprobe"
+)
+
+// mediaExtensions maps media file extensions to MIME types, for containers that
+// http.DetectContentType does not recognise (MPEG-TS, M2TS, FLAC, ...).
+var mediaExtensions = map[string]string{
+	".3gp":  "video/3gpp",
+	".asf":  "video/x-ms-asf",
+	".avi":  "video/x-msvideo",
+	".flv":  "video/x-flv",
+	".m2ts": "video/mp2t",
+	".m4v":  "video/mp4",
+	".mkv":  "video/x-matroska",
+	".mov":  "video/quicktime",
+	".mp4":  "video/mp4",
+	".mpeg": "video/mpeg",
+	".mpg":  "video/mpeg",
+	".mts":  "video/mp2t",
+	".ogv":  "video/ogg",
+	".ts":   "video/mp2t",
+	".vob":  "video/mpeg",
+	".webm": "video/webm",
+	".wmv":  "video/x-ms-wmv",
+
+	".aac":  "audio/aac",
+	".ac3":  "audio/ac3",
+	".aif":  "audio/aiff",
+	".aiff": "audio/aiff",
+	".alac": "audio/mp4",
+	".ape":  "audio/ape",
+	".dsf":  "audio/dsf",
+	".flac": "audio/flac",
+	".m4a":  "audio/mp4",
+	".m4b":  "audio/mp4",
+	".mka":  "audio/x-matroska",
+	".mp3":  "audio/mpeg",
+	".oga":  "audio/ogg",
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".wav":  "audio/wav",
+	".wma":  "audio/x-ms-wma",
+	".wv":   "audio/wavpack",
+}
+
+// containerMimeTypes maps ffprobe format names to the MIME type of a file with video.
+// Audio-only files use audioContainerMimeTypes, or audio/<format> when not listed.
+var containerMimeTypes = map[string]string{
+	"3gp":      "video/3gpp",
+	"asf":      "video/x-ms-asf",
+	"avi":      "video/x-msvideo",
+	"flv":      "video/x-flv",
+	"matroska": "video/x-matroska",
+	"mov":      "video/mp4",
+	"mp4":      "video/mp4",
+	"mpeg":     "video/mpeg",
+	"mpegts":   "video/mp2t",
+	"ogg":      "video/ogg",
+	"webm":     "video/webm",
+}
+
+var audioContainerMimeTypes = map[string]string{
+	"aiff":     "audio/aiff",
+	"asf":      "audio/x-ms-wma",
+	"matroska": "audio/x-matroska",
+	"mov":      "audio/mp4",
+	"mp4":      "audio/mp4",
+	"mp3":      "audio/mpeg",
+	"webm":     "audio/webm",
+}
+
+// mediaInfo describes what a file contains, as far as the classifier could tell.
+// It decides how a file is split and sent.
+type mediaInfo struct {
+	MimeType     string  `json:"mime_type"`
+	DetectedBy   string  `json:"detected_by"`         // The classifier layer that settled MimeType
+	Container    string  `json:"container,omitempty"` // ffprobe format name, such as "mpegts"
+	HasVideo     bool    `json:"has_video"`           // Excludes cover art
+	HasAudio     bool    `json:"has_audio"`
+	HasSubtitles bool    `json:"has_subtitles"`
+	VideoCodec   string  `json:"video_codec,omitempty"`
+	AudioCodec   string  `json:"audio_codec,omitempty"`
+	DurationS    float64 `json:"duration_seconds,omitempty"`
+}
+
+// isVideo reports whether the file should be split and sent as a video.
+func (m *mediaInfo) isVideo() bool {
+	return strings.HasPrefix(m.MimeType, "video/")
+}
+
+// isAudio reports whether the file should be split and sent as audio.
+func (m *mediaInfo) isAudio() bool {
+	return !m.isVideo() && strings.HasPrefix(m.MimeType, "audio/")
+}
+
+// classifyMedia works out the type of filePath in three layers: a magic-number sniff of
+// the first bytes, then the extension table, then ffprobe's format and stream list.
+// Each layer refines the previous one; ffprobe has the final word on whether a file
+// holds video or only audio (e.g. an .m4a that sniffs as video/mp4). The error is
+// only non-nil if the file cannot be read at all.
+func classifyMedia(filePath string) (*mediaInfo, error) {
+	sniffed, err := detectMimeType(filePath)
+	if err != nil {
+		return nil, err
+	}
+	info := &mediaInfo{MimeType: sniffed, DetectedBy: DetectedBySniff}
+
+	extType := mediaExtensions[strings.ToLower(filepath.Ext(filePath))]
+	// Sniffing says octet-stream for unknown data and application/ogg for any Ogg file
+	textSniff := strings.HasPrefix(sniffed, "text/plain")
+	if extType != "" && (sniffed == "application/octet-stream" || sniffed == "application/ogg" || textSniff) {
+		info.MimeType = extType
+		info.DetectedBy = DetectedByExtension
+	}
+
+	if !isMediaMimeType(info.MimeType) && sniffed != "application/octet-stream" {
+		return info, nil // Recognised as something else, such as an archive or a document
+	}
+	// Over a text sniff the extension is no hint: TypeScript sources are named .ts too
+	err = probeMedia(filePath, info, isMediaMimeType(info.MimeType) && !textSniff)
+	if textSniff && !info.HasVideo && !info.HasAudio {
+		info.MimeType = sniffed // ffprobe found no streams, so it is text after all
+		info.DetectedBy = DetectedBySniff
+	}
+	if err != nil {
+		log.Printf("Warning: ffprobe could not inspect %s: %v. Using the %s result %s.", filePath, err, info.DetectedBy, info.MimeType)
+	}
+	return info, nil
+}
+
+// isMediaMimeType reports whether mimeType is a video or audio type.
+func isMediaMimeType(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "video/") || strings.HasPrefix(mimeType, "audio/") || mimeType == "application/ogg"
+}
+
+// probeMedia fills in the container, streams and duration of info with ffprobe and
+// settles its MIME type. Without a hint from the earlier layers, a low probe score
+// is treated as not media.
+func probeMedia(filePath string, info *mediaInfo, hinted bool) error {
+	ffprobePath, err := exec.LookPath("ffprobe")
+	if err != nil {
+		return fmt.Errorf("ffprobe not found in PATH: %w", err)
+	}
+	cmd := exec.Command(ffprobePath,
+		"-v", "error",
+		"-show_entries", "format=format_name,duration,probe_score:stream=codec_type,codec_name:stream_disposition=attached_pic",
+		"-of", "json",
+		filePath,
+	)
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w\nStderr: %s", err, stderr.String())
+	}
+
+	var probeData struct {
+		Format struct {
+			FormatName string `json:"format_name"`
+			Duration   string `json:"duration"`
+			ProbeScore int    `json:"probe_score"`
+		} `json:"format"`
+		Streams []struct {
+			CodecType   string `json:"codec_type"`
+			CodecName   string `json:"codec_name"`
+			Disposition struct {
+				AttachedPic int `json:"attached_pic"`
+			} `json:"disposition"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &probeData); err != nil {
+		return fmt.Errorf("failed to parse ffprobe JSON: %w", err)
+	}
+	if !hinted && probeData.Format.ProbeScore < MinProbeScore {
+		return nil // A guess on data that is most likely not media
+	}
+
+	// format_name lists aliases, e.g. "mov,mp4,m4a,3gp,3g2,mj2"
+	info.Container, _, _ = strings.Cut(probeData.Format.FormatName, ",")
+	info.DurationS, _ = strconv.ParseFloat(probeData.Format.Duration, 64)
+	for _, st := range probeData.Streams {
+		switch st.CodecType {
+		case "video":
+			if st.Disposition.AttachedPic != 0 {
+				continue // Cover art
+			}
+			if !info.HasVideo {
+				info.VideoCodec = st.CodecName
+			}
+			info.HasVideo = true
+		case "audio":
+			if !info.HasAudio {
+				info.AudioCodec = st.CodecName
+			}
+			info.HasAudio = true
+		case "subtitle":
+			info.HasSubtitles = true
+		}
+	}
+
+	switch {
+	case info.HasVideo:
+		if !strings.HasPrefix(info.MimeType, "video/") {
+			info.MimeType = containerMimeTypes[info.Container]
+			if info.MimeType == "" {
+				info.MimeType = "video/x-" + info.Container
+			}
+			info.DetectedBy = DetectedByFFprobe
+		}
+	case info.HasAudio:
+		if !strings.HasPrefix(info.MimeType, "audio/") {
+			info.MimeType = audioContainerMimeTypes[info.Container]
+			if info.MimeType == "" {
+				info.MimeType = "audio/" + info.Container
+			}
+			info.DetectedBy = DetectedByFFprobe
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/amarnathcjd/gogram/telegram"
+)
+
+// uploadedPart is a part whose bytes were uploaded ahead of its turn, ready to be
+// posted to the chat as media. A nil media means the part is sent the usual way.
+type uploadedPart struct {
+	media  telegram.InputMedia
+	bot    *botClient // The bot of the pool that uploaded it, which has to post it too
+	sha256 string     // Of range parts, hashed while uploading ahead
+}
+
+// sendParts sends the parts of the state in order. With opts.Parallel above 1, the
+// bytes of up to that many parts are uploaded at the same time, while the messages
+// are still posted one after the other in part order. partPaths is nil for range parts.
+func (s *partSender) sendParts(partPaths []string) {
+	pathOf := func(i int) string {
+		if partPaths == nil {
+			return ""
+		}
+		return partPaths[i]
+	}
+	count := len(s.state.Parts)
+	if s.opts.Parallel <= 1 || count < 2 {
+		for i := range count {
+			if s.ctx.Err() != nil {
+				log.Printf("Upload of '%s' cancelled before part %d.", s.name, i+1)
+				return
+			}
+			s.send(i, pathOf(i))
+		}
+		return
+	}
+	log.Printf("Uploading up to %d parts of '%s' at the same time.", s.opts.Parallel, s.name)
+
+	// ahead holds one token per part that is being uploaded or waiting to be posted
+	ahead := make(chan struct{}, s.opts.Parallel)
+	ready := make([]chan *uploadedPart, count)
+	for i := range ready {
+		ready[i] = make(chan *uploadedPart, 1)
+	}
+	done := make(chan struct{})
+	defer close(done) // Workers finish the upload they are in, which is then discarded
+
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		for i := range count {
+			select {
+			case ahead <- struct{}{}:
+			case <-done:
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-done:
+				return
+			}
+		}
+	}()
+	for range s.opts.Parallel {
+		go func() {
+			for i := range jobs {
+				ready[i] <- s.uploadAhead(i, pathOf(i))
+			}
+		}()
+	}
+
+	for i := range count {
+		if s.ctx.Err() != nil {
+			log.Printf("Upload of '%s' cancelled before part %d.", s.name, i+1)
+			return
+		}
+		s.sendPart(i, pathOf(i), <-ready[i])
+		<-ahead
+	}
+}
+
+// uploadAhead uploads the bytes of part i (0-based) without posting it. It returns nil
+// for parts that were already sent, and an uploadedPart without media for parts in
+// the media cache or whose upload failed, which are then sent the usual way.
+func (s *partSender) uploadAhead(i int, partPath string) *uploadedPart {
+	saved := s.state.Parts[i] // Only the poster writes to the state
+	if saved.MessageID != 0 || s.ctx.Err() != nil {
+		return nil
+	}
+	partNum := i + 1
+	partFileName := s.partName(partNum)
+	up := &uploadedPart{sha256: saved.SHA256}
+
+	sourcePath, offset := partPath, int64(0)
+	if s.state.Strategy == StrategyRange {
+		sourcePath, offset = s.state.Source, int64(i)*s.state.PartSize
+		if up.sha256 == "" && s.hashRanges() {
+			if sum, err := rangeSHA256(sourcePath, offset, saved.Size); err == nil {
+				up.sha256 = sum
+			} else {
+				log.Printf("Warning: Could not hash part %d of %s: %v", partNum, sourcePath, err)
+			}
+		}
+	}
+	if s.cache != nil && up.sha256 != "" && s.cache.get(mediaCacheKey(up.sha256, saved.Size, partFileName)) != nil {
+		return up // Sent by reference when its turn comes
+	}
+
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		log.Printf("Warning: Could not upload part %d ahead: %v. Uploading it in turn.", partNum, err)
+		return up
+	}
+	defer source.Close()
+	r := io.NewSectionReader(source, offset, saved.Size)
+	if s.sealer != nil {
+		sealed, err := s.sealer.seal(source, offset, saved.Size)
+		if err != nil {
+			log.Printf("Warning: Could not encrypt part %d ahead: %v. Uploading it in turn.", partNum, err)
+			return up
+		}
+		r = io.NewSectionReader(sealed, 0, sealed.Size())
+	}
+
+	client := s.client
+	if up.bot = s.bots.acquire(s.events); up.bot != nil {
+		client = up.bot.client
+	}
+	startTime := time.Now()
+	log.Printf("Uploading part %d ahead: %s", partNum, partFileName)
+	file, err := uploadRange(client, r, partFileName, s.events, s.bots.maxWait(), func(totalSize, currentSize int64) {
+		s.events.emit(EventUploadProgress, event{
+			File:     partFileName,
+			Part:     partNum,
+			Bytes:    currentSize,
+			Total:    totalSize,
+			Percent:  float64(currentSize) / float64(totalSize) * 100,
+			SpeedBps: float64(currentSize) / time.Since(startTime).Seconds(),
+		})
+	})
+	if err != nil {
+		log.Printf("Warning: Could not upload part %d ahead: %v. Uploading it in turn.", partNum, err)
+		if up.bot != nil {
+			up.bot.report(0, err.Error())
+		}
+		return up
+	}
+	log.Printf("Uploaded part %d ahead in %.2f s.", partNum, time.Since(startTime).Seconds())
+	up.media = s.uploadedMedia(file, partPath, partFileName, saved)
+	return up
+}
+
+// uploadedMedia describes an uploaded part to Telegram the way sendFile and sendAudio
+// would: video parts as streamable videos, audio parts with their tags, and everything
+// else, including encrypted parts, as plain documents.
+func (s *partSender) uploadedMedia(file telegram.InputFile, partPath, partFileName string, saved partState) telegram.InputMedia {
+	media := &telegram.InputMediaUploadedDocument{
+		File:       file,
+		MimeType:   "application/octet-stream",
+		ForceFile:  true,
+		Attributes: []telegram.DocumentAttribute{&telegram.DocumentAttributeFilename{FileName: partFileName}},
+	}
+	if s.sealer != nil {
+		return media
+	}
+	switch s.state.Strategy {
+	case StrategyVideo:
+		media.MimeType = mimeTypeOf(partPath, "video/", "video/mp4")
+		media.ForceFile = false
+		attribute := &telegram.DocumentAttributeVideo{Duration: saved.DurationS, SupportsStreaming: true}
+		if w, h, err := getVideoDimensions(partPath); err == nil {
+			attribute.W, attribute.H = w, h
+		} else {
+			log.Printf("Warning: Could not read the dimensions of part %d: %v", saved.Index, err)
+		}
+		media.Attributes = append(media.Attributes, attribute)
+	case StrategyAudio:
+		media.MimeType = mimeTypeOf(partPath, "audio/", "audio/mpeg")
+		media.ForceFile = false
+		suffix := fmt.Sprintf(" (Part %d/%d)", saved.Index, s.total)
+		media.Attributes = append(media.Attributes, s.tags.attribute(saved.DurationS, suffix))
+	}
+	return media
+}
+
+// mimeTypeOf returns the MIME type of path's extension if it has the given prefix, or fallback.
+func mimeTypeOf(path, prefix, fallback string) string {
+	mimeType, _, _ := strings.Cut(mime.TypeByExtension(filepath.Ext(path)), ";")
+	if !strings.HasPrefix(mimeType, prefix) {
+		return fallback
+	}
+	return mimeType
+}
+
+// sendUploaded posts media uploaded ahead of time as a message, with the same status
+// messages, events and flood-wait handling as sendFile.
+func sendUploaded(client *telegram.Client, chatID string, media telegram.InputMedia, captionFileName string, size int64, partNum int, events *eventStream, maxWait time.Duration) partResult {
+	return sendMedia(client, chatID, captionFileName, size, partNum, events, maxWait, func(func(totalSize, currentSize int64)) (*telegram.NewMessage, error) {
+		return client.SendMedia(chatID, media, &telegram.MediaOptions{FileName: captionFileName})
+	})
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+const (
+	// MaxParityShards is the most data and parity parts a single Reed-Solomon code covers.
+	MaxParityShards = 256
+	// ParityBlockSize is how much of each part is held in memory at once while encoding.
+	ParityBlockSize = 1 * 1024 * 1024
+)
+
+// parityInfo describes the parity parts sent after the data parts of an upload.
+// Any len(Parts) missing data parts can be rebuilt from the others and the parity.
+type parityInfo struct {
+	ShardSize int64        `json:"shard_size"` // Data parts are zero-padded to this size for encoding
+	DataParts int          `json:"data_parts"`
+	Parts     []partResult `json:"parts"`
+}
+
+// parityCount returns the number of parity parts for dataParts parts under spec, which
+// is either a count ("3") or a percentage of the data parts ("10%"), rounded up.
+func parityCount(spec string, dataParts int) (int, error) {
+	if percent, ok := strings.CutSuffix(spec, "%"); ok {
+		p, err := strconv.ParseFloat(percent, 64)
+		if err != nil || p < 0 {
+			return 0, fmt.Errorf("invalid parity percentage '%s'", spec)
+		}
+		return int(math.Ceil(float64(dataParts) * p / 100)), nil
+	}
+	n, err := strconv.Atoi(spec)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid parity count '%s': must be a number of parts or a percentage such as '10%%'", spec)
+	}
+	return n, nil
+}
+
+// sendParity computes Reed-Solomon parity parts over the byte-range parts of the source
+// and sends them after the data parts. Parity parts are written next to the source and
+// removed once sent; pipelined uploads write them opts.Pipeline at a time, reading the
+// source once per batch, so that no more parts are on disk at once than while splitting.
+func (s *partSender) sendParity() error {
+	if s.state.Strategy != StrategyGeneric && s.state.Strategy != StrategyRange {
+		log.Printf("Warning: Parity parts are only computed for generic parts, not for %s parts of '%s'.", s.state.Strategy, s.name)
+		return nil
+	}
+	dataParts := len(s.state.Parts)
+	count, err := parityCount(s.opts.Parity, dataParts)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return nil
+	}
+	if dataParts+count > MaxParityShards {
+		return fmt.Errorf("%d data parts and %d parity parts exceed the limit of %d parts", dataParts, count, MaxParityShards)
+	}
+	enc, err := reedsolomon.NewStream(dataParts, count, reedsolomon.WithStreamBlockSize(ParityBlockSize))
+	if err != nil {
+		return fmt.Errorf("failed to create Reed-Solomon encoder: %w", err)
+	}
+
+	info := &parityInfo{ShardSize: s.state.PartSize, DataParts: dataParts}
+	paths := make([]string, count)
+	for k := range paths {
+		paths[k] = filepath.Join(filepath.Dir(s.state.Source), fmt.Sprintf("%s.parity%03d", filepath.Base(s.state.Source), k+1))
+	}
+	batch := count
+	if s.opts.Pipeline > 0 {
+		batch = s.opts.Pipeline
+	}
+
+	log.Printf("Computing %d parity part(s) over %d parts of '%s'.", count, dataParts, s.name)
+	for first := 0; first < count; first += batch {
+		last := min(first+batch, count)
+		if err := writeParityParts(s.ctx, enc, s.state.Source, s.state.SourceSize, dataParts, info.ShardSize, paths, first, last); err != nil {
+			return err
+		}
+		for k := first; k < last; k++ {
+			sum, err := fileSHA256(paths[k])
+			if err != nil {
+				cleanupParts(paths[k:last])
+				return err
+			}
+			name := fmt.Sprintf("%s (Parity %d/%d)", s.documentName(), k+1, count)
+			var part partResult
+			if s.sealer != nil {
+				part = sendSealed(s.client, s.chatID, s.sealer, paths[k], 0, -1, name, k+1, s.events, 0)
+			} else {
+				part = sendFile(s.client, s.chatID, paths[k], name, k+1, s.events, 0)
+			}
+			part.SHA256 = sum
+			if err := os.Remove(paths[k]); err != nil && !os.IsNotExist(err) {
+				log.Printf("Warning: Failed to remove parity part %s: %v", paths[k], err)
+			}
+			if part.Error != "" {
+				cleanupParts(paths[k+1 : last])
+				return fmt.Errorf("failed to send parity part %d: %s", k+1, part.Error)
+			}
+			info.Parts = append(info.Parts, part)
+		}
+	}
+	s.result.Parity = info
+	return nil
+}
+
+// writeParityParts encodes the data parts of sourcePath, each shardSize bytes of the
+// source, and writes parity parts first to last-1 to their paths. The other parity
+// parts are computed but discarded.
+func writeParityParts(ctx context.Context, enc reedsolomon.StreamEncoder, sourcePath string, sourceSize int64, dataParts int, shardSize int64, paths []string, first, last int) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return fmt.Errorf("failed to open source file %s: %w", sourcePath, err)
+	}
+	defer source.Close()
+
+	data := make([]io.Reader, dataParts)
+	for i := range data {
+		offset := int64(i) * shardSize
+		data[i] = paddedShard(ctx, io.NewSectionReader(source, offset, min(shardSize, sourceSize-offset)), shardSize)
+	}
+	parity := make([]io.Writer, len(paths))
+	var files []*os.File
+	for k := range parity {
+		if k < first || k >= last {
+			parity[k] = io.Discard
+			continue
+		}
+		f, err := os.Create(paths[k])
+		if err != nil {
+			closeParityFiles(files, true)
+			return fmt.Errorf("failed to create parity part %s: %w", paths[k], err)
+		}
+		files = append(files, f)
+		parity[k] = f
+	}
+
+	if err := enc.Encode(data, parity); err != nil {
+		closeParityFiles(files, true)
+		return fmt.Errorf("error computing parity parts: %w", err)
+	}
+	return closeParityFiles(files, false)
+}
+
+// closeParityFiles closes parity part files, removing them all if remove is set or any
+// of them fails to close.
+func closeParityFiles(files []*os.File, remove bool) error {
+	var firstErr error
+	for _, f := range files {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("error closing parity part %s: %w", f.Name(), err)
+		}
+	}
+	if remove || firstErr != nil {
+		for _, f := range files {
+			os.Remove(f.Name())
+		}
+	}
+	return firstErr
+}
+
+// paddedShard returns r followed by zeros up to shardSize bytes, as the encoder needs
+// parts of equal size. Reading stops with ctx's error once ctx is cancelled.
+func paddedShard(ctx context.Context, r *io.SectionReader, shardSize int64) io.Reader {
+	return &ctxReader{ctx: ctx, r: io.MultiReader(r, io.LimitReader(zeroReader{}, shardSize-r.Size()))}
+}
+
+// zeroReader is an endless stream of zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// ctxReader is a reader that fails once ctx is cancelled.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// rebuildDataParts recreates the data parts of plan that could not be downloaded from the
+// remaining data parts and the downloaded parity parts, and verifies them against their
+// recorded sizes and checksums.
+func rebuildDataParts(plan *joinPlan, missing []int) error {
+	available := 0
+	for _, p := range plan.Parity {
+		if p.Path != "" {
+			available++
+		}
+	}
+	if len(missing) > available {
+		return fmt.Errorf("%d parts are missing but only %d parity parts could be downloaded", len(missing), available)
+	}
+	enc, err := reedsolomon.NewStream(len(plan.Parts), len(plan.Parity), reedsolomon.WithStreamBlockSize(ParityBlockSize))
+	if err != nil {
+		return fmt.Errorf("failed to create Reed-Solomon decoder: %w", err)
+	}
+
+	valid := make([]io.Reader, len(plan.Parts)+len(plan.Parity))
+	fill := make([]io.Writer, len(valid))
+	var open []*os.File
+	defer func() {
+		for _, f := range open {
+			f.Close()
+		}
+	}()
+	for i, p := range plan.Parts {
+		if p.Path == "" {
+			continue
+		}
+		f, err := os.Open(p.Path)
+		if err != nil {
+			return fmt.Errorf("failed to open part %s: %w", p.Path, err)
+		}
+		open = append(open, f)
+		size := plan.shardLength(i)
+		valid[i] = paddedShard(context.Background(), io.NewSectionReader(f, 0, size), plan.ShardSize)
+	}
+	for k, p := range plan.Parity {
+		if p.Path == "" {
+			continue
+		}
+		f, err := os.Open(p.Path)
+		if err != nil {
+			return fmt.Errorf("failed to open parity part %s: %w", p.Path, err)
+		}
+		open = append(open, f)
+		valid[len(plan.Parts)+k] = f
+	}
+	for _, i := range missing {
+		p := &plan.Parts[i]
+		p.Path = plan.partPath(p.Index)
+		f, err := os.Create(p.Path)
+		if err != nil {
+			return fmt.Errorf("failed to create part %s: %w", p.Path, err)
+		}
+		open = append(open, f)
+		fill[i] = f
+	}
+
+	log.Printf("Rebuilding %d missing part(s) from %d parity part(s).", len(missing), available)
+	if err := enc.Reconstruct(valid, fill); err != nil {
+		return fmt.Errorf("error rebuilding missing parts: %w", err)
+	}
+	for _, i := range missing {
+		p := plan.Parts[i]
+		f := fill[i].(*os.File)
+		// The rebuilt part is padded like the encoder's input
+		if err := f.Truncate(plan.shardLength(i)); err != nil {
+			return fmt.Errorf("failed to trim rebuilt part %s: %w", p.Path, err)
+		}
+		if err := verifyDownloadedPart(p); err != nil {
+			return fmt.Errorf("rebuilt part is wrong: %w", err)
+		}
+		log.Printf("Rebuilt part %d: %s", p.Index, p.Path)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// parityFixture is a source file split into data parts, with parity parts computed over it.
+type parityFixture struct {
+	source []byte
+	plan   *joinPlan
+}
+
+// newParityFixture writes a source of size bytes to dir, its data parts of shardSize
+// bytes and parityParts parity parts, written in batches of batch parts as pipelined
+// uploads do, and plans the join of them all.
+func newParityFixture(t *testing.T, dir string, size, shardSize int64, parityParts, batch int) *parityFixture {
+	t.Helper()
+	source := make([]byte, size)
+	rand.New(rand.NewSource(size)).Read(source)
+	sourcePath := filepath.Join(dir, "source.bin")
+	if err := os.WriteFile(sourcePath, source, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	dataParts := int((size + shardSize - 1) / shardSize)
+	enc, err := reedsolomon.NewStream(dataParts, parityParts, reedsolomon.WithStreamBlockSize(ParityBlockSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := make([]string, parityParts)
+	for k := range paths {
+		paths[k] = filepath.Join(dir, fmt.Sprintf("source.bin.parity%03d", k+1))
+	}
+	for first := 0; first < parityParts; first += batch {
+		if err := writeParityParts(context.Background(), enc, sourcePath, size, dataParts, shardSize, paths, first, min(first+batch, parityParts)); err != nil {
+			t.Fatalf("writeParityParts: %v", err)
+		}
+	}
+
+	plan := &joinPlan{FileName: "file.bin", FileSize: size, Dir: dir, ShardSize: shardSize}
+	for i := range dataParts {
+		part := source[int64(i)*shardSize : min(int64(i+1)*shardSize, size)]
+		path := filepath.Join(dir, fmt.Sprintf("part%03d", i+1))
+		if err := os.WriteFile(path, part, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		sum, err := fileSHA256(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan.Parts = append(plan.Parts, downloadPart{Index: i + 1, Size: int64(len(part)), SHA256: sum, Path: path})
+	}
+	for k, path := range paths {
+		plan.Parity = append(plan.Parity, downloadPart{Index: k + 1, Path: path})
+	}
+	return &parityFixture{source: source, plan: plan}
+}
+
+// drop removes data parts (0-based) as if their download had failed.
+func (f *parityFixture) drop(t *testing.T, parts ...int) {
+	t.Helper()
+	for _, i := range parts {
+		if err := os.Remove(f.plan.Parts[i].Path); err != nil {
+			t.Fatal(err)
+		}
+		f.plan.Parts[i].Path = ""
+	}
+}
+
+func TestRebuildDataParts(t *testing.T) {
+	const shardSize = 4096
+	tests := []struct {
+		name        string
+		size        int64
+		parityParts int
+		batch       int
+		missing     []int
+	}{
+		{"one part", 5*shardSize - 123, 2, 2, []int{1}},
+		{"short last part", 5*shardSize - 123, 2, 2, []int{4}},
+		{"as many as parity parts", 5*shardSize - 123, 2, 2, []int{0, 4}},
+		{"parity written in batches", 6 * shardSize, 3, 1, []int{0, 2, 5}},
+		{"single data part", shardSize / 2, 1, 1, []int{0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newParityFixture(t, t.TempDir(), tt.size, shardSize, tt.parityParts, tt.batch)
+			f.drop(t, tt.missing...)
+
+			if err := rebuildDataParts(f.plan, tt.missing); err != nil {
+				t.Fatalf("rebuildDataParts: %v", err)
+			}
+			var joined []byte
+			for _, p := range f.plan.Parts {
+				data, err := os.ReadFile(p.Path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				joined = append(joined, data...)
+			}
+			if !bytes.Equal(joined, f.source) {
+				t.Errorf("rebuilt parts do not join to the source")
+			}
+		})
+	}
+}
+
+func TestRebuildDataPartsTooManyMissing(t *testing.T) {
+	f := newParityFixture(t, t.TempDir(), 20000, 4096, 2, 2)
+	f.drop(t, 0, 2)
+	f.plan.Parity[1].Path = "" // Parity part failed to download too
+
+	err := rebuildDataParts(f.plan, []int{0, 2})
+	if err == nil || !strings.Contains(err.Error(), "only 1 parity parts") {
+		t.Fatalf("rebuildDataParts = %v, want an error about too few parity parts", err)
+	}
+}
+
+func TestRebuildDataPartsChecksumMismatch(t *testing.T) {
+	f := newParityFixture(t, t.TempDir(), 20000, 4096, 1, 1)
+	f.drop(t, 3)
+	f.plan.Parts[3].SHA256 = strings.Repeat("0", 64)
+
+	if err := rebuildDataParts(f.plan, []int{3}); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("rebuildDataParts = %v, want a checksum mismatch", err)
+	}
+}
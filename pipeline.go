@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+// sendPipelined splits and sends filePath at the same time: each part is uploaded
+// and deleted as soon as it has been produced, and the splitter waits whenever
+// lookahead parts are already on disk. Peak extra disk usage is therefore bounded
+// by lookahead × part size instead of the size of the whole file.
+//
+// Parts are not kept for resume. When resuming, the file is split again and parts
+// whose checksum matches one that previous records as sent are skipped.
+func (s *partSender) sendPipelined(filePath string, fileInfo os.FileInfo, previous *uploadState, lookahead int) *uploadResult {
+	s.state = s.newState(filePath, fileInfo, previous)
+	if s.state.Strategy == StrategyGeneric {
+		s.total = int((fileInfo.Size() + PartSize - 1) / PartSize)
+	}
+
+	statusText := fmt.Sprintf("Sending '%s' in parts as they are split...", s.name)
+	if s.total > 0 {
+		statusText = fmt.Sprintf("Sending '%s' in %d parts...", s.name, s.total)
+	}
+	if previous != nil {
+		statusText = fmt.Sprintf("Resuming '%s': splitting again and skipping %d parts already sent...", s.name, previous.sentCount())
+	}
+	statusMsg := s.postStatus(statusText)
+	log.Printf("Pipelined split of '%s' with at most %d part(s) on disk.", s.name, lookahead)
+
+	// slots holds one token per part that is on disk or being written. The splitter
+	// takes a token before producing a part; the uploader returns it after deleting one.
+	slots := make(chan struct{}, lookahead)
+	slots <- struct{}{}
+	parts := make(chan splitPart, lookahead)
+	splitErrc := make(chan error, 1)
+
+	splitCtx, stopSplit := context.WithCancel(s.ctx)
+	defer stopSplit()
+
+	go func() {
+		defer close(parts)
+		onPart := func(partNum int, part splitPart) error {
+			select {
+			case parts <- part:
+			case <-splitCtx.Done():
+				os.Remove(part.Path)
+				return splitCtx.Err()
+			}
+			// Reserve disk budget for the next part before the splitter continues
+			select {
+			case slots <- struct{}{}:
+				return nil
+			case <-splitCtx.Done():
+				return splitCtx.Err()
+			}
+		}
+
+		var err error
+		if s.isVideo || s.isAudio {
+			_, err = s.splitMedia(splitCtx, filePath, onPart)
+			if errors.Is(err, errNoMediaSplit) {
+				// No part was handed over yet, so the uploader has not touched the state
+				log.Printf("Warning: Could not split '%s' into playable parts: %v. Splitting into generic parts.", s.name, err)
+				s.fallBackToGeneric(fileInfo.Size())
+				_, err = s.splitGeneric(splitCtx, filePath, onPart)
+			}
+			if err != nil {
+				err = fmt.Errorf("error splitting media file '%s': %w", filePath, err)
+			}
+		} else {
+			_, err = s.splitGeneric(splitCtx, filePath, onPart)
+			if err != nil {
+				err = fmt.Errorf("error splitting generic file '%s': %w", filePath, err)
+			}
+		}
+		splitErrc <- err
+	}()
+
+	var uploadErr error
+	for part := range parts {
+		partPath := part.Path
+		if s.ctx.Err() == nil && uploadErr == nil {
+			if err := s.state.appendPart(part, previous); err != nil {
+				uploadErr = err
+				stopSplit()
+			} else {
+				saveState(s.store, s.state)
+				s.send(len(s.state.Parts)-1, partPath)
+			}
+		}
+
+		log.Printf("Cleaning up temporary part: %s", partPath)
+		if err := os.Remove(partPath); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: Failed to remove temporary part %s: %v", partPath, err)
+		}
+		<-slots
+	}
+
+	splitErr := <-splitErrc
+	if uploadErr == nil && splitErr != nil && s.ctx.Err() == nil {
+		uploadErr = splitErr
+	}
+	if uploadErr == nil && s.ctx.Err() == nil {
+		s.state.SplitDone = true
+		s.total = len(s.state.Parts)
+		saveState(s.store, s.state)
+	}
+
+	result := s.finish(statusMsg, uploadErr)
+	if result.Success && s.store != nil {
+		if err := s.store.clearState(); err != nil {
+			log.Printf("Warning: Failed to clear upload state for %s: %v", filePath, err)
+		}
+	}
+	return result
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/amarnathcjd/gogram/telegram"
+)
+
+const (
+	// UploadChunkSize is the size of each file part request (512 KB, the MTProto maximum).
+	UploadChunkSize = 512 * 1024
+	// BigFileThreshold is the size above which Telegram requires the "big file" upload API.
+	BigFileThreshold = 10 * 1024 * 1024
+	// UploadWorkers is the number of chunks uploaded concurrently for a range upload.
+	UploadWorkers = 4
+	// UploadChunkRetries is how many times a failed chunk is retried before giving up.
+	UploadChunkRetries = 3
+	// ProgressUpdateInterval throttles progress callbacks for range uploads.
+	ProgressUpdateInterval = 5 * time.Second
+)
+
+// sendRanges sends a generic file as parts that are uploaded straight from
+// offset/length windows of the source, without writing any temporary files.
+// Parts are presented to Telegram with the same names as copied parts.
+func (s *partSender) sendRanges(filePath string, fileInfo os.FileInfo, previous *uploadState) *uploadResult {
+	if previous != nil && previous.Strategy == StrategyRange && previous.SplitDone {
+		s.state = previous
+		log.Printf("Resuming '%s' from saved state: %d of %d parts already sent.", s.name, previous.sentCount(), len(previous.Parts))
+	} else {
+		s.state = s.newState(filePath, fileInfo, previous)
+		s.state.Strategy = StrategyRange
+		s.state.PartSize = PartSize
+		for offset := int64(0); offset < fileInfo.Size(); offset += PartSize {
+			s.state.Parts = append(s.state.Parts, partState{
+				Index: len(s.state.Parts) + 1,
+				Size:  min(PartSize, fileInfo.Size()-offset),
+			})
+		}
+		s.state.SplitDone = true
+		saveState(s.store, s.state)
+	}
+	s.total = len(s.state.Parts)
+	s.events.emit(EventSplitStarted, event{File: s.name, Strategy: StrategyRange, Total: fileInfo.Size()})
+	s.events.emit(EventSplitFinished, event{File: s.name, Strategy: StrategyRange, Parts: s.total})
+	log.Printf("Sending '%s' as %d byte ranges without temporary files.", s.name, s.total)
+
+	statusText := fmt.Sprintf("Sending '%s' in %d parts...", s.name, s.total)
+	if previous != nil {
+		statusText = fmt.Sprintf("Resuming '%s' in %d parts (%d already sent)...", s.name, s.total, s.state.sentCount())
+	}
+	statusMsg := s.postStatus(statusText)
+	s.sendParts(nil)
+
+	result := s.finish(statusMsg, nil)
+	if result.Success && s.store != nil {
+		if err := s.store.clearState(); err != nil {
+			log.Printf("Warning: Failed to clear upload state for %s: %v", filePath, err)
+		}
+	}
+	return result
+}
+
+// sendRange sends size bytes of sourcePath starting at offset as a document named captionFileName.
+func sendRange(client *telegram.Client, chatID, sourcePath string, offset, size int64, captionFileName string, partNum int, events *eventStream, maxWait time.Duration) partResult {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		log.Printf("Error opening %s for sending: %v", sourcePath, err)
+		client.SendMessage(chatID, fmt.Sprintf("Error preparing to send %s: %v", captionFileName, err))
+		return partResult{Index: partNum, MessageID: -1, FileName: captionFileName, Error: err.Error()}
+	}
+	defer source.Close()
+
+	return sendMedia(client, chatID, captionFileName, size, partNum, events, maxWait, func(onProgress func(totalSize, currentSize int64)) (*telegram.NewMessage, error) {
+		file, err := uploadRange(client, io.NewSectionReader(source, offset, size), captionFileName, events, maxWait, onProgress)
+		if err != nil {
+			return nil, err
+		}
+		media := &telegram.InputMediaUploadedDocument{
+			File:       file,
+			MimeType:   "application/octet-stream",
+			ForceFile:  true,
+			Attributes: []telegram.DocumentAttribute{&telegram.DocumentAttributeFilename{FileName: captionFileName}},
+		}
+		return client.SendMedia(chatID, media, &telegram.MediaOptions{FileName: captionFileName})
+	})
+}
+
+// uploadRange uploads the contents of r as a file named fileName and returns the
+// InputFile to send it with. Chunks are read with ReadAt and uploaded by a small
+// pool of workers; flood waits and transient errors are retried per chunk.
+func uploadRange(client *telegram.Client, r *io.SectionReader, fileName string, events *eventStream, maxWait time.Duration, onProgress func(totalSize, currentSize int64)) (telegram.InputFile, error) {
+	size := r.Size()
+	if size <= 0 {
+		return nil, fmt.Errorf("cannot upload empty range for %s", fileName)
+	}
+	fileID, err := randomFileID()
+	if err != nil {
+		return nil, err
+	}
+	totalParts := int32((size + UploadChunkSize - 1) / UploadChunkSize)
+	big := size > BigFileThreshold
+
+	var (
+		uploaded   atomic.Int64
+		failed     atomic.Bool
+		firstErr   error
+		errOnce    sync.Once
+		wg         sync.WaitGroup
+		progressMu sync.Mutex
+		lastReport time.Time
+	)
+	chunks := make(chan int32)
+
+	for w := 0; w < UploadWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, UploadChunkSize)
+			for chunk := range chunks {
+				if failed.Load() {
+					continue // Drain the queue once any chunk has failed
+				}
+				n, err := r.ReadAt(buf, int64(chunk)*UploadChunkSize)
+				if err != nil && err != io.EOF {
+					errOnce.Do(func() { firstErr = fmt.Errorf("failed to read chunk %d of %s: %w", chunk, fileName, err) })
+					failed.Store(true)
+					continue
+				}
+				if err := saveChunk(client, fileID, chunk, totalParts, big, buf[:n], events, maxWait); err != nil {
+					errOnce.Do(func() { firstErr = fmt.Errorf("failed to upload chunk %d of %s: %w", chunk, fileName, err) })
+					failed.Store(true)
+					continue
+				}
+
+				done := uploaded.Add(int64(n))
+				progressMu.Lock()
+				if time.Since(lastReport) >= ProgressUpdateInterval || done == size {
+					lastReport = time.Now()
+					onProgress(size, done)
+				}
+				progressMu.Unlock()
+			}
+		}()
+	}
+
+	for chunk := int32(0); chunk < totalParts; chunk++ {
+		chunks <- chunk
+	}
+	close(chunks)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if big {
+		return &telegram.InputFileBig{ID: fileID, Parts: totalParts, Name: fileName}, nil
+	}
+	return &telegram.InputFileObj{ID: fileID, Parts: totalParts, Name: fileName}, nil
+}
+
+// saveChunk uploads a single file part, sleeping through flood waits and retrying other errors.
+func saveChunk(client *telegram.Client, fileID int64, chunk, totalParts int32, big bool, data []byte, events *eventStream, maxWait time.Duration) error {
+	var err error
+	for attempt := 1; attempt <= UploadChunkRetries; attempt++ {
+		if big {
+			_, err = client.UploadSaveBigFilePart(fileID, chunk, totalParts, data)
+		} else {
+			_, err = client.UploadSaveFilePart(fileID, chunk, data)
+		}
+		if err == nil {
+			return nil
+		}
+		if !handleIfFloodWithin(err, events, maxWait) {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+	return err
+}
+
+// randomFileID returns a random non-zero ID for a new upload.
+func randomFileID() (int64, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, fmt.Errorf("failed to generate upload file ID: %w", err)
+	}
+	id := int64(binary.LittleEndian.Uint64(b[:]) >> 1)
+	if id == 0 {
+		id = 1
+	}
+	return id, nil
+}
+
+// rangeSHA256 returns the hex-encoded SHA-256 digest of size bytes of a file starting at offset.
+func rangeSHA256(filePath string, offset, size int64) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s for hashing: %w", filePath, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, offset, size)); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", filePath, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
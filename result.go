@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/amarnathcjd/gogram/telegram"
+)
+
+// Output formats accepted by the --output flag.
+const (
+	OutputIDs  = "ids"  // Legacy: a single ID or comma-separated IDs on stdout
+	OutputJSON = "json" // A single uploadResult document on stdout
+)
+
+// uploadResult is the machine-readable summary of a whole upload, printed to
+// stdout when --output json is set. The same schema covers direct sends and
+// split uploads; a direct send is simply a result with one part.
+type uploadResult struct {
+	ChatID            string           `json:"chat_id"`
+	FileName          string           `json:"file_name"`
+	FileSize          int64            `json:"file_size"`
+	SHA256            string           `json:"sha256,omitempty"` // Of the whole file, set when a manifest was built
+	MimeType          string           `json:"mime_type,omitempty"`
+	Media             *mediaInfo       `json:"media,omitempty"`
+	Split             bool             `json:"split"`
+	Strategy          string           `json:"strategy,omitempty"`       // Split strategy, one of the Strategy* constants
+	SplitMethod       string           `json:"split_method,omitempty"`   // SplitMethod* constant that split a video or audio file
+	SplitFailures     []splitFailure   `json:"split_failures,omitempty"` // Split methods that failed before it
+	Parts             []partResult     `json:"parts"`
+	Parity            *parityInfo      `json:"parity,omitempty"`
+	ManifestMessageID int32            `json:"manifest_message_id,omitempty"`
+	Encryption        *encryptionInfo  `json:"encryption,omitempty"`
+	Compression       *compressionInfo `json:"compression,omitempty"` // FileName, FileSize and SHA256 are of the compressed copy
+	Copies            []copyResult     `json:"copies,omitempty"`      // Deliveries to the chats in uploadOptions.CopyTo
+	Success           bool             `json:"success"`
+	Error             string           `json:"error,omitempty"`
+	StartedAt         time.Time        `json:"started_at"`
+	ElapsedS          float64          `json:"elapsed_seconds"`
+
+	// Kept for deliverCopies
+	manifest *manifest // The manifest sent to ChatID, nil if none was sent
+	sealer   *sealer   // Seals the manifests sent to the other chats
+
+	hashParts bool // Whether addPart hashes parts whose checksum is not known yet
+}
+
+// partResult describes a single sent file or split part.
+type partResult struct {
+	Index     int     `json:"index"` // 1-based part number
+	MessageID int32   `json:"message_id"`
+	FileName  string  `json:"file_name"`
+	Size      int64   `json:"size"`
+	SHA256    string  `json:"sha256,omitempty"`
+	DurationS float64 `json:"duration_seconds,omitempty"` // Media duration for video parts
+	UploadS   float64 `json:"upload_seconds"`
+	Resumed   bool    `json:"resumed,omitempty"` // Sent by an earlier, interrupted run
+	Cached    bool    `json:"cached,omitempty"`  // Sent by reference to a document from the media cache
+	Bot       string  `json:"bot,omitempty"`     // The bot of the pool that sent the part
+	Error     string  `json:"error,omitempty"`
+
+	document *telegram.DocumentObj // The document sent, for the media cache
+}
+
+// newUploadResult creates an empty result for the given chat and source file.
+func newUploadResult(chatID, fileName string, fileSize int64) *uploadResult {
+	return &uploadResult{
+		ChatID:    chatID,
+		FileName:  fileName,
+		FileSize:  fileSize,
+		Parts:     []partResult{},
+		StartedAt: time.Now().UTC(),
+	}
+}
+
+// addPart records a part result, filling in the part's size and, if not yet known and
+// r.hashParts is set, its checksum from disk.
+func (r *uploadResult) addPart(part partResult, partPath string) {
+	if info, err := os.Stat(partPath); err == nil {
+		part.Size = info.Size()
+	}
+	if part.SHA256 == "" && r.hashParts {
+		if sum, err := fileSHA256(partPath); err == nil {
+			part.SHA256 = sum
+		}
+	}
+	r.Parts = append(r.Parts, part)
+}
+
+// messageIDs returns the IDs of all successfully sent parts, in part order.
+func (r *uploadResult) messageIDs() []int32 {
+	var ids []int32
+	for _, p := range r.Parts {
+		if p.Error == "" && p.MessageID != -1 {
+			ids = append(ids, p.MessageID)
+		}
+	}
+	return ids
+}
+
+// finish marks the result as complete. A nil err with no failed parts means success.
+func (r *uploadResult) finish(err error) {
+	r.ElapsedS = time.Since(r.StartedAt).Seconds()
+	r.Success = err == nil
+	if err != nil {
+		r.Error = err.Error()
+	}
+	for _, p := range r.Parts {
+		if p.Error != "" {
+			r.Success = false
+		}
+	}
+	if r.Success && len(r.Parts) == 0 && r.FileSize > 0 {
+		r.Success = false
+		r.Error = "no parts were sent"
+	}
+}
+
+// writeResult prints the result to w in the requested output format.
+func writeResult(w io.Writer, r *uploadResult, format string) error {
+	switch format {
+	case OutputJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	default:
+		ids := r.messageIDs()
+		strIds := make([]string, len(ids))
+		for i, id := range ids {
+			strIds[i] = fmt.Sprintf("%d", id)
+		}
+		_, err := fmt.Fprint(w, strings.Join(strIds, ","))
+		return err
+	}
+}
+
+// fileSHA256 returns the hex-encoded SHA-256 digest of a file.
+func fileSHA256(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s for hashing: %w", filePath, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", filePath, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SegmentTimeToleranceSec is how far a segment written by the segment muxer may start
+// from its planned cut point before the single-pass split is rejected.
+const SegmentTimeToleranceSec = 0.05
+
+// segmentVideo writes all planned segments of sourcePath in one ffmpeg run with the
+// segment muxer, reading the source once from start to end. Cut times are placed just
+// before each planned keyframe, where the muxer starts the next segment.
+//
+// On success every segment's Precut is set to the file holding it. The segment list
+// ffmpeg writes is checked against the plan in one pass; if the segments do not line
+// up, all of them are removed and an error is returned.
+func segmentVideo(ctx context.Context, ffmpegPath, sourcePath string, plan []mediaSegment) error {
+	if len(plan) < 2 {
+		return nil // Nothing to cut; the single part is cut as usual
+	}
+	sourceDir := filepath.Dir(sourcePath)
+	sourceBaseName := filepath.Base(sourcePath)
+	sourceExt := filepath.Ext(sourceBaseName)
+	sourceNameOnly := strings.TrimSuffix(sourceBaseName, sourceExt)
+	escapedName := strings.ReplaceAll(sourceNameOnly, "%", "%%") // The pattern is a printf format for ffmpeg
+	pattern := filepath.Join(sourceDir, escapedName+"_segment%03d"+strings.ReplaceAll(sourceExt, "%", "%%"))
+	listPath := filepath.Join(sourceDir, sourceNameOnly+"_segments.csv")
+	defer os.Remove(listPath)
+
+	times := make([]string, 0, len(plan)-1)
+	for _, seg := range plan[1:] {
+		times = append(times, strconv.FormatFloat(seg.Start-2*KeyframeCutOffsetSec, 'f', 6, 64))
+	}
+
+	cmd := exec.CommandContext(ctx, ffmpegPath,
+		"-v", "error",
+		"-i", sourcePath,
+		"-c", "copy", // Copy streams without re-encoding
+		"-map", "0", // Map all streams
+		"-avoid_negative_ts", "make_non_negative",
+		"-f", "segment",
+		"-segment_times", strings.Join(times, ","),
+		"-segment_start_number", "1",
+		"-segment_list", listPath,
+		"-segment_list_type", "csv",
+		"-segment_format_options", "movflags=+faststart",
+		"-reset_timestamps", "1", // Each part starts at zero, like a separately cut part
+		"-y",
+		pattern,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	log.Printf("Running ffmpeg: %s", cmd.String())
+	err := cmd.Run()
+	written, listErr := readSegmentList(listPath, sourceDir)
+	if err == nil {
+		err = listErr
+	}
+	if err == nil {
+		err = checkSegments(written, plan)
+	}
+	if err != nil {
+		// Remove by number too, in case ffmpeg stopped before listing a segment
+		for i := 1; i <= max(len(written), len(plan)); i++ {
+			os.Remove(fmt.Sprintf(pattern, i))
+		}
+		for _, entry := range written {
+			os.Remove(entry.path)
+		}
+		if stderr.Len() > 0 {
+			return fmt.Errorf("%w\nStderr: %s", err, stderr.String())
+		}
+		return err
+	}
+
+	for i := range plan {
+		plan[i].Precut = written[i].path
+	}
+	log.Printf("Wrote %d segments of '%s' in a single pass.", len(written), sourceBaseName)
+	return nil
+}
+
+// segmentEntry is one line of the segment muxer's CSV list.
+type segmentEntry struct {
+	path  string
+	start float64
+}
+
+// readSegmentList parses the CSV segment list written by ffmpeg. Entries name files
+// relative to dir.
+func readSegmentList(listPath, dir string) ([]segmentEntry, error) {
+	f, err := os.Open(listPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open segment list %s: %w", listPath, err)
+	}
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse segment list %s: %w", listPath, err)
+	}
+	entries := make([]segmentEntry, 0, len(records))
+	for _, rec := range records {
+		if len(rec) < 3 {
+			return entries, fmt.Errorf("malformed segment list line: %q", strings.Join(rec, ","))
+		}
+		start, err := strconv.ParseFloat(rec[1], 64)
+		entries = append(entries, segmentEntry{path: filepath.Join(dir, filepath.Base(rec[0])), start: start})
+		if err != nil {
+			return entries, fmt.Errorf("malformed segment times in list line: %q", strings.Join(rec, ","))
+		}
+	}
+	return entries, nil
+}
+
+// checkSegments verifies that the muxer wrote one non-empty segment per planned part,
+// each starting at its planned keyframe.
+func checkSegments(written []segmentEntry, plan []mediaSegment) error {
+	if len(written) != len(plan) {
+		return fmt.Errorf("segment muxer wrote %d segments, expected %d", len(written), len(plan))
+	}
+	for i, entry := range written {
+		want := plan[i].Start
+		if i > 0 {
+			want -= KeyframeCutOffsetSec // The keyframe itself
+		}
+		if math.Abs(entry.start-want) > SegmentTimeToleranceSec {
+			return fmt.Errorf("segment %d starts at %.3fs instead of %.3fs", i+1, entry.start, want)
+		}
+		info, err := os.Stat(entry.path)
+		if err != nil {
+			return fmt.Errorf("failed to stat segment %s: %w", entry.path, err)
+		}
+		if info.Size() == 0 {
+			return fmt.Errorf("segment %s is empty", entry.path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/amarnathcjd/gogram/telegram"
+)
+
+// Job states reported by the daemon API.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+const (
+	// DefaultListenAddr is where the daemon listens unless --listen is given.
+	DefaultListenAddr = "127.0.0.1:8089"
+	// JobQueueSize bounds the number of jobs waiting for a worker.
+	JobQueueSize = 256
+)
+
+// job is a single upload request handled by the daemon.
+type job struct {
+	ID         string        `json:"id"`
+	ChatID     string        `json:"chat_id"`
+	Path       string        `json:"path"`
+	Options    uploadOptions `json:"options"`
+	Status     string        `json:"status"`
+	CreatedAt  time.Time     `json:"created_at"`
+	StartedAt  *time.Time    `json:"started_at,omitempty"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+	Progress   *event        `json:"progress,omitempty"` // Most recent event
+	Result     *uploadResult `json:"result,omitempty"`
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// jobRequest is the body accepted by POST /jobs.
+type jobRequest struct {
+	ChatID  string        `json:"chat_id"`
+	Path    string        `json:"path"`
+	Options uploadOptions `json:"options"`
+}
+
+// jobManager owns the logged-in client and runs queued jobs on a fixed pool of workers.
+type jobManager struct {
+	client *telegram.Client
+	bots   *botPool // Shared by all jobs, nil with a single bot
+	events *eventStream
+	store  *jobStore
+	cache  *mediaCache // Shared by all jobs, nil if disabled
+
+	mu           sync.Mutex
+	jobs         map[string]*job
+	queue        chan string
+	done         chan struct{} // Closed by stop; the queue itself is never closed
+	wg           sync.WaitGroup
+	shuttingDown bool
+}
+
+// runServe keeps a single logged-in client alive and accepts upload jobs over HTTP.
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listenAddr := fs.String("listen", DefaultListenAddr, "Address for the job API")
+	workers := fs.Int("workers", 1, "Number of jobs uploaded concurrently")
+	eventsTarget := fs.String("events", "", "Write NDJSON progress events for all jobs to 'stderr', 'fd:<n>', 'unix:<socket>' or a file path")
+	dbPath := fs.String("db", DefaultJobDBPath, "Embedded database that persists jobs across restarts")
+	user := fs.Bool("user", false, "Upload as the user account logged in by the login command; Premium accounts send files of up to 3.9 GB without splitting")
+	session := fs.String("session", DefaultUserSession, "Session file of the user account for --user")
+	cachePath := fs.String("cache", DefaultMediaCachePath, "Media cache database; content sent before is sent again by reference instead of uploading it ('' disables the cache)")
+	fs.Parse(args)
+
+	if *workers < 1 {
+		log.Fatalf("Invalid --workers value %d: must be at least 1", *workers)
+	}
+
+	events, err := openEventStream(*eventsTarget)
+	if err != nil {
+		log.Fatalf("Error opening event stream: %v", err)
+	}
+	defer events.Close()
+
+	store, err := openJobStore(*dbPath)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	defer store.Close()
+
+	client, bots, err := newUploadClient(*user, *session)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	manager := newJobManager(client, bots, events, store, newMediaCache(*cachePath))
+	manager.start(*workers)
+	if err := manager.recoverJobs(); err != nil {
+		log.Fatalf("Error recovering jobs: %v", err)
+	}
+
+	srv := &http.Server{
+		Addr:    *listenAddr,
+		Handler: manager.routes(),
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-stop
+		log.Println("Shutting down job API...")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Warning: Job API shutdown failed: %v", err)
+		}
+	}()
+
+	log.Printf("Job API listening on %s with %d worker(s).", *listenAddr, *workers)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("Job API failed: %v", err)
+	}
+	manager.stop()
+}
+
+func newJobManager(client *telegram.Client, bots *botPool, events *eventStream, store *jobStore, cache *mediaCache) *jobManager {
+	return &jobManager{
+		client: client,
+		bots:   bots,
+		events: events,
+		store:  store,
+		cache:  cache,
+		jobs:   make(map[string]*job),
+		queue:  make(chan string, JobQueueSize),
+		done:   make(chan struct{}),
+	}
+}
+
+// start launches n workers that consume the job queue.
+func (m *jobManager) start(n int) {
+	for i := 0; i < n; i++ {
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			for {
+				select {
+				case <-m.done:
+					return
+				case id := <-m.queue:
+					select {
+					case <-m.done: // Shutting down: leave the job queued in the database
+						return
+					default:
+					}
+					m.run(id)
+				}
+			}
+		}()
+	}
+}
+
+// recoverJobs loads saved jobs and re-queues those that were queued or running
+// when the daemon last stopped. Running jobs resume from their saved part state.
+func (m *jobManager) recoverJobs() error {
+	saved, err := m.store.loadJobs()
+	if err != nil {
+		return err
+	}
+
+	var pending []string
+	m.mu.Lock()
+	for _, j := range saved {
+		if j.Status == JobQueued || j.Status == JobRunning {
+			j.ctx, j.cancel = context.WithCancel(context.Background())
+			j.Status = JobQueued
+			j.StartedAt = nil
+			pending = append(pending, j.ID)
+		}
+		m.jobs[j.ID] = j
+	}
+	m.mu.Unlock()
+
+	if len(pending) > 0 {
+		log.Printf("Recovered %d unfinished job(s) from the job database.", len(pending))
+	}
+	// Queue in the background: there may be more recovered jobs than queue slots.
+	go func() {
+		for _, id := range pending {
+			select {
+			case m.queue <- id:
+			case <-m.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// persist saves j to the job database. Must be called with m.mu held.
+func (m *jobManager) persist(j *job) {
+	if err := m.store.putJob(*j); err != nil {
+		log.Printf("Warning: Failed to persist job %s: %v", j.ID, err)
+	}
+}
+
+// stop cancels all pending and running jobs and waits for the workers to exit.
+// Unfinished jobs stay queued in the job database and resume on the next start.
+func (m *jobManager) stop() {
+	m.mu.Lock()
+	m.shuttingDown = true
+	for _, j := range m.jobs {
+		if j.cancel != nil {
+			j.cancel()
+		}
+	}
+	close(m.done)
+	m.mu.Unlock()
+	m.wg.Wait()
+}
+
+// submit validates and enqueues a new job.
+func (m *jobManager) submit(req jobRequest) (*job, error) {
+	if req.ChatID == "" || req.Path == "" {
+		return nil, fmt.Errorf("chat_id and path are required")
+	}
+	if _, err := os.Stat(req.Path); err != nil {
+		return nil, fmt.Errorf("cannot access %s: %w", req.Path, err)
+	}
+	if err := req.Options.validate(); err != nil {
+		return nil, err
+	}
+	if err := validateCopyTo(req.ChatID, req.Options.CopyTo); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		ID:        newJobID(),
+		ChatID:    req.ChatID,
+		Path:      req.Path,
+		Options:   req.Options,
+		Status:    JobQueued,
+		CreatedAt: time.Now().UTC(),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.shuttingDown {
+		cancel()
+		return nil, fmt.Errorf("job API is shutting down")
+	}
+	select {
+	case m.queue <- j.ID:
+	default:
+		cancel()
+		return nil, fmt.Errorf("job queue is full (%d jobs waiting)", JobQueueSize)
+	}
+	m.jobs[j.ID] = j
+	m.persist(j)
+	log.Printf("Queued job %s: %s -> %s", j.ID, j.Path, j.ChatID)
+	return j, nil
+}
+
+// run executes a single job on the calling worker.
+func (m *jobManager) run(id string) {
+	m.mu.Lock()
+	j, ok := m.jobs[id]
+	if !ok || j.Status != JobQueued {
+		m.mu.Unlock()
+		return
+	}
+	now := time.Now().UTC()
+	j.Status = JobRunning
+	j.StartedAt = &now
+	m.persist(j)
+	m.mu.Unlock()
+
+	log.Printf("Starting job %s: %s -> %s", id, j.Path, j.ChatID)
+	jobEvents := m.events.forJob(id, func(ev event) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		evCopy := ev
+		evCopy.Result = nil // The final result is stored on the job itself
+		j.Progress = &evCopy
+	})
+	result := runUpload(j.ctx, m.client, j.ChatID, j.Path, j.Options, jobEvents, m.store.stateFor(id), m.cache, m.bots)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defer m.persist(j)
+	if j.ctx.Err() != nil && m.shuttingDown {
+		// Leave the job queued; it resumes from its saved state after a restart.
+		j.Status = JobQueued
+		j.Result = result
+		log.Printf("Job %s interrupted by shutdown; it will resume on restart.", id)
+		return
+	}
+	finished := time.Now().UTC()
+	j.FinishedAt = &finished
+	j.Result = result
+	switch {
+	case j.ctx.Err() != nil:
+		j.Status = JobCancelled
+		m.discardState(id)
+	case result.Success:
+		j.Status = JobDone
+	default:
+		j.Status = JobFailed
+	}
+	j.cancel()
+	log.Printf("Job %s finished with status %s.", id, j.Status)
+}
+
+// cancelJob cancels a queued or running job.
+func (m *jobManager) cancelJob(id string) (*job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return nil, nil
+	}
+	switch j.Status {
+	case JobQueued:
+		j.Status = JobCancelled
+		finished := time.Now().UTC()
+		j.FinishedAt = &finished
+		m.discardState(id)
+		m.persist(j)
+	case JobRunning:
+		// The worker marks the job cancelled once the current step returns.
+	default:
+		return j, fmt.Errorf("job %s already %s", id, j.Status)
+	}
+	j.cancel()
+	return j, nil
+}
+
+// discardState deletes the saved part state of a cancelled job along with any parts kept for resume.
+func (m *jobManager) discardState(id string) {
+	store := m.store.stateFor(id)
+	st, err := store.loadState()
+	if err != nil || st == nil {
+		return
+	}
+	cleanupParts(st.partPaths())
+	if err := store.clearState(); err != nil {
+		log.Printf("Warning: Failed to clear state of job %s: %v", id, err)
+	}
+}
+
+// snapshot returns a copy of a job that is safe to encode outside the lock.
+func (m *jobManager) snapshot(id string) (job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return job{}, false
+	}
+	return *j, true
+}
+
+// list returns copies of all jobs, oldest first.
+func (m *jobManager) list() []job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jobs := make([]job, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		jobs = append(jobs, *j)
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].CreatedAt.Before(jobs[b].CreatedAt) })
+	return jobs
+}
+
+// routes wires up the job API:
+//
+//	POST   /jobs       submit {"chat_id", "path", "options"}; returns the job
+//	GET    /jobs       list all jobs
+//	GET    /jobs/{id}  job status, latest progress event and result
+//	DELETE /jobs/{id}  cancel a queued or running job
+//	GET    /bots       health of the bots that parts are spread over
+func (m *jobManager) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /jobs", func(w http.ResponseWriter, r *http.Request) {
+		var req jobRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid job request: %w", err))
+			return
+		}
+		j, err := m.submit(req)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		snap, _ := m.snapshot(j.ID)
+		writeJSON(w, http.StatusAccepted, snap)
+	})
+	mux.HandleFunc("GET /jobs", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, m.list())
+	})
+	mux.HandleFunc("GET /bots", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, m.bots.health())
+	})
+	mux.HandleFunc("GET /jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		snap, ok := m.snapshot(r.PathValue("id"))
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, fmt.Errorf("job %s not found", r.PathValue("id")))
+			return
+		}
+		writeJSON(w, http.StatusOK, snap)
+	})
+	mux.HandleFunc("DELETE /jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		j, err := m.cancelJob(r.PathValue("id"))
+		if j == nil {
+			writeJSONError(w, http.StatusNotFound, fmt.Errorf("job %s not found", r.PathValue("id")))
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusConflict, err)
+			return
+		}
+		snap, _ := m.snapshot(j.ID)
+		writeJSON(w, http.StatusAccepted, snap)
+	})
+	return mux
+}
+
+// newJobID returns a random 16-character hex job ID.
+func newJobID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%016x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Warning: Failed to write API response: %v", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
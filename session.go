@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/amarnathcjd/gogram/telegram"
+)
+
+const (
+	// DefaultUserSession is the session file of the user account unless --session is given.
+	DefaultUserSession = "user.session"
+	// UserPhoneEnv holds the phone number the login command logs in with unless -phone is given.
+	UserPhoneEnv = "PHONE_NUMBER"
+)
+
+// runLogin logs in a user account once, asking for the login code and the two-step
+// verification password on the terminal, and keeps the session for --user uploads.
+func runLogin(args []string) {
+	fs := flag.NewFlagSet("login", flag.ExitOnError)
+	session := fs.String("session", DefaultUserSession, "File the user session is kept in")
+	phone := fs.String("phone", os.Getenv(UserPhoneEnv), "Phone number of the account, in international format (defaults to $"+UserPhoneEnv+")")
+	fs.Parse(args)
+
+	client, err := newClient(*session)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if authorized, err := client.IsAuthorized(); err == nil && authorized {
+		log.Printf("Session %s is already logged in.", *session)
+	} else {
+		stdin := bufio.NewReader(os.Stdin)
+		if *phone == "" {
+			if *phone, err = prompt(stdin, "Phone number: "); err != nil {
+				log.Fatalf("%v", err)
+			}
+		}
+		_, err = client.Login(*phone, &telegram.LoginOptions{
+			CodeCallback:     func() (string, error) { return prompt(stdin, "Login code: ") },
+			PasswordCallback: func() (string, error) { return prompt(stdin, "Two-step verification password: ") },
+		})
+		if err != nil {
+			log.Fatalf("Error logging in as %s: %v", *phone, err)
+		}
+	}
+
+	me, err := client.GetMe()
+	if err != nil {
+		log.Fatalf("Error getting the logged-in account: %v", err)
+	}
+	limit := BotMaxFileSize
+	if me.Premium {
+		limit = PremiumMaxFileSize
+	}
+	log.Printf("Logged in as %s (ID %d, Premium: %t). Session saved to %s; upload with --user to send files of up to %d MB.",
+		displayName(me), me.ID, me.Premium, *session, limit/1024/1024)
+}
+
+// newUserClient connects the user account logged in by the login command. Uploads
+// made in the process may use parts of up to PremiumMaxFileSize if it has Premium.
+func newUserClient(session string) (*telegram.Client, error) {
+	client, err := newClient(session)
+	if err != nil {
+		return nil, err
+	}
+	if authorized, err := client.IsAuthorized(); err != nil || !authorized {
+		return nil, fmt.Errorf("session %s is not logged in: run '%s login' first", session, os.Args[0])
+	}
+	me, err := client.GetMe()
+	if err != nil {
+		return nil, fmt.Errorf("error getting the logged-in account: %w", err)
+	}
+	if me.Bot {
+		return nil, fmt.Errorf("session %s belongs to a bot, not a user account", session)
+	}
+	if me.Premium {
+		MaxFileSize = PremiumMaxFileSize
+		PartSize = MaxFileSize
+	}
+	log.Printf("Telegram client logged in as %s (Premium: %t, files up to %d MB).", displayName(me), me.Premium, MaxFileSize/1024/1024)
+	return client, nil
+}
+
+// newUploadClient connects the client uploads are sent with: the user account of
+// session if user is set, or else the bot with the bot pool of BotTokensEnv, if any.
+func newUploadClient(user bool, session string) (*telegram.Client, *botPool, error) {
+	if user {
+		if os.Getenv(BotTokensEnv) != "" {
+			log.Printf("Warning: Ignoring %s; uploads as a user account are not spread over bots.", BotTokensEnv)
+		}
+		client, err := newUserClient(session)
+		return client, nil, err
+	}
+	client, err := newBotClient()
+	if err != nil {
+		return nil, nil, err
+	}
+	bots, err := newBotPool(client, os.Getenv("BOT_TOKEN"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error logging in the bots of %s: %w", BotTokensEnv, err)
+	}
+	return client, bots, nil
+}
+
+// displayName returns the @username of an account, or its first name.
+func displayName(me *telegram.UserObj) string {
+	if me.Username != "" {
+		return "@" + me.Username
+	}
+	return me.FirstName
+}
+
+// prompt writes label to stderr and reads a line from r.
+func prompt(r *bufio.Reader, label string) (string, error) {
+	fmt.Fprint(os.Stderr, label)
+	line, err := r.ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("no input for %s: %w", strings.TrimSuffix(label, ": "), err)
+	}
+	return strings.TrimSpace(line), nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// StateFileSuffix is appended to the source path to name the --resume state file.
+const StateFileSuffix = ".upload-state.json"
+
+// Split strategies recorded in the upload state.
+const (
+	StrategyVideo     = "video"     // Time-based ffmpeg segments
+	StrategyAudio     = "audio"     // Time-based ffmpeg segments of an audio file
+	StrategyGeneric   = "generic"   // Byte-range copies in temporary part files
+	StrategyRange     = "range"     // Byte ranges uploaded straight from the source, no part files
+	StrategyTranscode = "transcode" // Re-encoded time ranges, created and sent one at a time
+	StrategyArchive   = "archive"   // Volumes of a store-only zip archive of the source
+)
+
+// uploadState records the progress of a split upload so that an interrupted
+// upload can resume at the first unsent part instead of starting over.
+type uploadState struct {
+	ChatID        string      `json:"chat_id"`
+	Source        string      `json:"source"`
+	SourceSize    int64       `json:"source_size"`
+	SourceModTime time.Time   `json:"source_mod_time"`
+	Strategy      string      `json:"strategy"`            // One of the Strategy* constants
+	PartSize      int64       `json:"part_size,omitempty"` // Byte size of generic parts
+	SplitDone     bool        `json:"split_done"`
+	StatusMsgID   int32       `json:"status_message_id,omitempty"`
+	Encrypt       string      `json:"encrypt,omitempty"` // Encryption mode the parts were sent with
+	Parts         []partState `json:"parts"`
+	UpdatedAt     time.Time   `json:"updated_at"`
+}
+
+// partState is the persisted state of a single split part.
+type partState struct {
+	Index     int     `json:"index"` // 1-based part number
+	Path      string  `json:"path"`
+	Size      int64   `json:"size"`
+	SHA256    string  `json:"sha256,omitempty"`
+	StartS    float64 `json:"start_seconds,omitempty"`    // Video parts: offset into the source
+	DurationS float64 `json:"duration_seconds,omitempty"` // Video parts: segment length
+	MessageID int32   `json:"message_id,omitempty"`       // Zero until the part has been sent
+}
+
+// stateStore persists the uploadState of a single upload.
+type stateStore interface {
+	// loadState returns the saved state, or nil if there is none.
+	loadState() (*uploadState, error)
+	saveState(st *uploadState) error
+	clearState() error
+}
+
+// newUploadState creates the state for a freshly split upload.
+func newUploadState(chatID, source string, sourceInfo os.FileInfo, strategy string) *uploadState {
+	return &uploadState{
+		ChatID:        chatID,
+		Source:        source,
+		SourceSize:    sourceInfo.Size(),
+		SourceModTime: sourceInfo.ModTime().UTC(),
+		Strategy:      strategy,
+	}
+}
+
+// matches reports whether the state was recorded for the same chat and an unchanged source file.
+func (st *uploadState) matches(chatID, source string, sourceInfo os.FileInfo) bool {
+	return st.ChatID == chatID &&
+		st.Source == source &&
+		st.SourceSize == sourceInfo.Size() &&
+		st.SourceModTime.Equal(sourceInfo.ModTime().UTC())
+}
+
+// setParts records freshly split parts with their sizes and checksums and marks the split as done.
+// Parts that previous recorded as sent, with an identical checksum, keep their message IDs.
+func (st *uploadState) setParts(parts []splitPart, previous *uploadState) error {
+	st.Parts = nil
+	for _, p := range parts {
+		if err := st.appendPart(p, previous); err != nil {
+			return err
+		}
+	}
+	st.SplitDone = true
+	return nil
+}
+
+// appendPart records the next freshly split part with its size and checksum.
+// Video parts keep the time range they were cut from, so that a single missing part can be cut again later.
+// If previous recorded the same part, with an identical checksum, as sent, its message ID is kept.
+func (st *uploadState) appendPart(sp splitPart, previous *uploadState) error {
+	i := len(st.Parts)
+	path := sp.Path
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat part %s: %w", path, err)
+	}
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return err
+	}
+	part := partState{Index: i + 1, Path: path, Size: info.Size(), SHA256: sum}
+	if st.Strategy == StrategyVideo || st.Strategy == StrategyAudio {
+		part.StartS = sp.StartS
+		part.DurationS = sp.DurationS
+	}
+
+	if previous != nil && i < len(previous.Parts) && previous.Parts[i].MessageID != 0 {
+		if previous.Parts[i].SHA256 == sum {
+			part.MessageID = previous.Parts[i].MessageID
+		} else {
+			log.Printf("Warning: Re-split part %d differs from the one sent earlier (message %d). Sending it again.", i+1, previous.Parts[i].MessageID)
+		}
+	}
+	st.Parts = append(st.Parts, part)
+	return nil
+}
+
+// restoreMissingParts re-creates unsent parts that are missing or truncated on disk,
+// leaving intact parts alone. Generic parts are copied from their byte range of the
+// source and video parts are cut again from their recorded time range.
+func (st *uploadState) restoreMissingParts(ctx context.Context) error {
+	if st.Strategy == StrategyRange {
+		return nil // Parts are read straight from the source
+	}
+	var ffmpegPath string
+	for i := range st.Parts {
+		p := &st.Parts[i]
+		if p.MessageID != 0 || partOnDisk(*p) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		log.Printf("Re-creating missing part %d: %s", p.Index, p.Path)
+
+		switch st.Strategy {
+		case StrategyGeneric:
+			if st.PartSize <= 0 {
+				return fmt.Errorf("saved state has no part size, cannot re-create part %d", p.Index)
+			}
+			if err := writeGenericPart(st.Source, p.Path, int64(p.Index-1)*st.PartSize, p.Size); err != nil {
+				return err
+			}
+		case StrategyVideo, StrategyAudio:
+			if ffmpegPath == "" {
+				path, err := exec.LookPath("ffmpeg")
+				if err != nil {
+					return fmt.Errorf("ffmpeg not found in PATH: %w", err)
+				}
+				ffmpegPath = path
+			}
+			if p.DurationS <= 0 {
+				return fmt.Errorf("saved state has no time range for part %d", p.Index)
+			}
+			if err := cutVideoSegment(ctx, ffmpegPath, st.Source, p.Path, p.StartS, p.DurationS); err != nil {
+				return fmt.Errorf("part %d: %w", p.Index, err)
+			}
+		case StrategyArchive:
+			// Each volume depends on everything before it; the archive is written again instead
+			return fmt.Errorf("zip volume %d is missing and cannot be re-created on its own", p.Index)
+		default:
+			return fmt.Errorf("unknown split strategy '%s' in saved state", st.Strategy)
+		}
+
+		sum, err := fileSHA256(p.Path)
+		if err != nil {
+			return err
+		}
+		if sum != p.SHA256 {
+			// Unsent, so nothing in the chat depends on the old bytes; just track the new ones.
+			log.Printf("Warning: Re-created part %d differs from the original split.", p.Index)
+			info, err := os.Stat(p.Path)
+			if err != nil {
+				return fmt.Errorf("failed to stat part %s: %w", p.Path, err)
+			}
+			p.SHA256 = sum
+			p.Size = info.Size()
+		}
+	}
+	return nil
+}
+
+// partOnDisk reports whether a part file exists with its recorded size.
+func partOnDisk(p partState) bool {
+	info, err := os.Stat(p.Path)
+	return err == nil && info.Size() == p.Size
+}
+
+// partPaths returns the paths of all parts in order.
+func (st *uploadState) partPaths() []string {
+	paths := make([]string, len(st.Parts))
+	for i, p := range st.Parts {
+		paths[i] = p.Path
+	}
+	return paths
+}
+
+// sentCount returns the number of parts that have already been sent.
+func (st *uploadState) sentCount() int {
+	n := 0
+	for _, p := range st.Parts {
+		if p.MessageID != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// loadResumeState loads the saved state from store, discarding it if it belongs to a different upload.
+// It returns nil when there is nothing to resume.
+func loadResumeState(store stateStore, chatID, source string, sourceInfo os.FileInfo) *uploadState {
+	if store == nil {
+		return nil
+	}
+	st, err := store.loadState()
+	if err != nil {
+		log.Printf("Warning: Could not load upload state for %s: %v. Starting from scratch.", source, err)
+		return nil
+	}
+	if st == nil {
+		return nil
+	}
+	if !st.matches(chatID, source, sourceInfo) {
+		log.Printf("Saved upload state for %s does not match the current file or chat. Starting from scratch.", source)
+		return nil
+	}
+	return st
+}
+
+// saveState persists st if a store is configured, logging (but not failing on) errors.
+func saveState(store stateStore, st *uploadState) {
+	if store == nil || st == nil {
+		return
+	}
+	st.UpdatedAt = time.Now().UTC()
+	if err := store.saveState(st); err != nil {
+		log.Printf("Warning: Failed to save upload state for %s: %v", st.Source, err)
+	}
+}
+
+// fileStateStore keeps the upload state in a JSON file next to the source, for --resume.
+type fileStateStore struct {
+	path string
+}
+
+// newFileStateStore returns the state store used by --resume for sourcePath.
+func newFileStateStore(sourcePath string) *fileStateStore {
+	return &fileStateStore{path: sourcePath + StateFileSuffix}
+}
+
+func (s *fileStateStore) loadState() (*uploadState, error) {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file %s: %w", s.path, err)
+	}
+	st := &uploadState{}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %w", s.path, err)
+	}
+	return st, nil
+}
+
+// saveState writes the state atomically so that a crash never leaves a truncated file.
+func (s *fileStateStore) saveState(st *uploadState) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode upload state: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary state file: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write state file %s: %w", s.path, err)
+	}
+	return nil
+}
+
+func (s *fileStateStore) clearState() error {
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amarnathcjd/gogram/telegram"
+)
+
+const (
+	// DefaultTranscodePreset is the libx264 preset used unless --transcode-preset is given.
+	DefaultTranscodePreset = "medium"
+	// TranscodeAudioBitrateKbps is the AAC bitrate of transcoded parts.
+	TranscodeAudioBitrateKbps = 128
+	// TranscodeMinVideoBitrateKbps is the lowest video bitrate worth encoding at.
+	// Longer videos need more parts instead.
+	TranscodeMinVideoBitrateKbps = 150
+	// TranscodeRetries is how many times an oversized part is encoded again at a lower bitrate.
+	TranscodeRetries = 2
+)
+
+// transcodePresets are the libx264 presets accepted by --transcode-preset, fastest first.
+var transcodePresets = []string{"ultrafast", "superfast", "veryfast", "faster", "fast", "medium", "slow", "slower", "veryslow"}
+
+// sendTranscoded re-encodes a video with libx264/AAC into opts.TranscodeParts parts of
+// equal duration (one part if unset), at a bitrate computed so that each part fits
+// under MaxFileSize. Unlike stream-copy cuts this works for sources with huge keyframe
+// intervals or broken timestamps. Each part is encoded, sent and deleted in turn, and
+// encoding progress is shown in the status message.
+func (s *partSender) sendTranscoded(filePath string, fileInfo os.FileInfo, previous *uploadState) *uploadResult {
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return failUpload(s.result, fmt.Errorf("ffmpeg not found in PATH: %w. Please install ffmpeg", err))
+	}
+	duration, err := getVideoDuration(filePath)
+	if err != nil {
+		return failUpload(s.result, fmt.Errorf("could not get video duration for %s: %w", filePath, err))
+	}
+	if duration <= 0 {
+		return failUpload(s.result, fmt.Errorf("video duration reported as zero or less for %s", filePath))
+	}
+	count := max(s.opts.TranscodeParts, 1)
+	preset := s.opts.TranscodePreset
+	if preset == "" {
+		preset = DefaultTranscodePreset
+	}
+
+	// Aim for the safety margin below the limit; never encode above the source's own bitrate
+	videoKbps := float64(MaxFileSize)*VideoSizeSafetyFactor*8/1000/(duration/float64(count)) - TranscodeAudioBitrateKbps
+	videoKbps = min(videoKbps, float64(fileInfo.Size())*8/1000/duration)
+	if videoKbps < TranscodeMinVideoBitrateKbps {
+		return failUpload(s.result, fmt.Errorf("'%s' is too long to fit into %d part(s): it would need a video bitrate of %.0f kbps", s.name, count, videoKbps))
+	}
+
+	s.name = strings.TrimSuffix(s.name, filepath.Ext(s.name)) + ".mp4"
+	if previous != nil && previous.Strategy == StrategyTranscode && len(previous.Parts) == count {
+		s.state = previous
+		log.Printf("Resuming '%s' from saved state: %d of %d parts already sent.", s.name, previous.sentCount(), count)
+	} else {
+		s.state = s.newState(filePath, fileInfo, previous)
+		s.state.Strategy = StrategyTranscode
+		sourceNameOnly := strings.TrimSuffix(fileInfo.Name(), filepath.Ext(fileInfo.Name()))
+		for i := 0; i < count; i++ {
+			s.state.Parts = append(s.state.Parts, partState{
+				Index:     i + 1,
+				Path:      filepath.Join(filepath.Dir(filePath), fmt.Sprintf("%s_transcoded%03d.mp4", sourceNameOnly, i+1)),
+				StartS:    duration * float64(i) / float64(count),
+				DurationS: duration / float64(count),
+			})
+		}
+		s.state.SplitDone = true
+		saveState(s.store, s.state)
+	}
+	s.total = count
+
+	log.Printf("Transcoding '%s' into %d part(s) at %.0f kbps video with preset %s.", s.name, count, videoKbps, preset)
+	s.events.emit(EventSplitStarted, event{File: s.name, Strategy: StrategyTranscode, Total: fileInfo.Size(), Parts: count})
+	statusMsg := s.postStatus(fmt.Sprintf("Transcoding '%s' into %d part(s)...", s.name, count))
+	updateStatus := statusUpdater(statusMsg)
+
+	var uploadErr error
+	for i := range s.state.Parts {
+		if s.ctx.Err() != nil {
+			log.Printf("Upload of '%s' cancelled before part %d.", s.name, i+1)
+			break
+		}
+		p := &s.state.Parts[i]
+		if p.MessageID == 0 && !partOnDisk(*p) {
+			// A bitrate lowered for an oversized part is kept for the parts after it
+			videoKbps, err = s.transcodePart(ffmpegPath, filePath, p, videoKbps, preset, updateStatus)
+			if err != nil {
+				uploadErr = err
+				break
+			}
+			saveState(s.store, s.state)
+			s.events.emit(EventPartCreated, event{File: filepath.Base(p.Path), Part: p.Index, Parts: count, Bytes: p.Size})
+		}
+		s.send(i, p.Path)
+		if p.MessageID != 0 {
+			log.Printf("Cleaning up transcoded part: %s", p.Path)
+			if err := os.Remove(p.Path); err != nil && !os.IsNotExist(err) {
+				log.Printf("Warning: Failed to remove transcoded part %s: %v", p.Path, err)
+			}
+		}
+	}
+	if uploadErr == nil && s.ctx.Err() == nil {
+		s.events.emit(EventSplitFinished, event{File: s.name, Strategy: StrategyTranscode, Parts: count})
+	}
+
+	result := s.finish(statusMsg, uploadErr)
+	if result.Success && s.store != nil {
+		if err := s.store.clearState(); err != nil {
+			log.Printf("Warning: Failed to clear upload state for %s: %v", filePath, err)
+		}
+	}
+	if !result.Success && s.store == nil {
+		cleanupParts(s.state.partPaths())
+	}
+	return result
+}
+
+// transcodePart encodes the time range of p, lowering the bitrate and encoding again
+// if the output comes out over MaxFileSize. It records the part's size and checksum and
+// returns the video bitrate the part was encoded at.
+func (s *partSender) transcodePart(ffmpegPath, sourcePath string, p *partState, videoKbps float64, preset string, updateStatus func(text string)) (float64, error) {
+	for attempt := 0; ; attempt++ {
+		lastPercent := -1
+		onProgress := func(done float64) {
+			percent := int(100 * (float64(p.Index-1) + done) / float64(s.total))
+			if percent == lastPercent || percent%5 != 0 {
+				return
+			}
+			lastPercent = percent
+			s.events.emit(EventTranscodeProgress, event{File: s.name, Part: p.Index, Parts: s.total, Percent: float64(percent)})
+			updateStatus(fmt.Sprintf("Transcoding '%s': part %d/%d, %d%% overall", s.name, p.Index, s.total, percent))
+		}
+		if err := transcodeSegment(s.ctx, ffmpegPath, sourcePath, p.Path, p.StartS, p.DurationS, videoKbps, preset, onProgress); err != nil {
+			return 0, fmt.Errorf("part %d: %w", p.Index, err)
+		}
+
+		info, err := os.Stat(p.Path)
+		if err != nil {
+			return 0, fmt.Errorf("failed to stat transcoded part %s: %w", p.Path, err)
+		}
+		if info.Size() <= MaxFileSize {
+			sum, err := fileSHA256(p.Path)
+			if err != nil {
+				return 0, err
+			}
+			p.Size = info.Size()
+			p.SHA256 = sum
+			log.Printf("Transcoded part %d: %s (Size: %.2f MB)", p.Index, p.Path, float64(p.Size)/1024/1024)
+			return videoKbps, nil
+		}
+
+		os.Remove(p.Path)
+		if attempt >= TranscodeRetries {
+			return 0, fmt.Errorf("transcoded part %d is still %d bytes after %d attempts", p.Index, info.Size(), attempt+1)
+		}
+		lowered := (videoKbps+TranscodeAudioBitrateKbps)*float64(MaxFileSize)*VideoSizeSafetyFactor/float64(info.Size()) - TranscodeAudioBitrateKbps
+		log.Printf("Warning: Transcoded part %d is %d bytes, over MaxFileSize (%d bytes). Encoding it again at %.0f kbps instead of %.0f kbps.",
+			p.Index, info.Size(), MaxFileSize, lowered, videoKbps)
+		s.events.emit(EventPartResplit, event{File: filepath.Base(p.Path), Part: p.Index, Bytes: info.Size(), Total: MaxFileSize,
+			Detail: fmt.Sprintf("transcoded part %d came out at %d bytes; encoding again at %.0f kbps", p.Index, info.Size(), lowered)})
+		if lowered < TranscodeMinVideoBitrateKbps {
+			return 0, fmt.Errorf("transcoded part %d does not fit even at %.0f kbps", p.Index, videoKbps)
+		}
+		videoKbps = lowered
+	}
+}
+
+// statusUpdater returns a function that edits msg, if any, to show encoding progress.
+// Encoding does not wait for flood waits: an edit that hits one is dropped, and so is
+// every edit until the wait is over.
+func statusUpdater(msg *telegram.NewMessage) func(text string) {
+	var quietUntil time.Time
+	return func(text string) {
+		if msg == nil || time.Now().Before(quietUntil) {
+			return
+		}
+		_, err := msg.Edit(text)
+		if err == nil {
+			return
+		}
+		wait, isFlood := floodWait(err.Error())
+		if !isFlood {
+			log.Printf("Warning: Could not update the status message: %v", err)
+			return
+		}
+		if wait == 0 {
+			wait = DefaultFloodWait
+		}
+		quietUntil = time.Now().Add(wait)
+		log.Printf("Warning: Status message updates hit a flood wait; skipping them for %v.", wait)
+	}
+}
+
+// transcodeSegment re-encodes duration seconds of sourcePath, starting at startTime, into
+// an MP4 at partFilePath. onProgress receives the fraction of the segment encoded so far.
+// The partial output is removed on failure.
+func transcodeSegment(ctx context.Context, ffmpegPath, sourcePath, partFilePath string, startTime, duration, videoKbps float64, preset string, onProgress func(done float64)) error {
+	bitrate := strconv.Itoa(int(videoKbps)) + "k"
+	bufsize := strconv.Itoa(int(2*videoKbps)) + "k"
+	cmd := exec.CommandContext(ctx, ffmpegPath,
+		"-v", "error",
+		"-nostats",
+		"-progress", "pipe:1",
+		"-ss", strconv.FormatFloat(startTime, 'f', 6, 64), // Accurate when re-encoding
+		"-i", sourcePath,
+		"-t", strconv.FormatFloat(duration, 'f', 6, 64),
+		"-map", "0:v:0",
+		"-map", "0:a?",
+		"-c:v", "libx264",
+		"-preset", preset,
+		"-b:v", bitrate,
+		"-maxrate", bitrate, // Cap peaks so the part cannot overshoot by much
+		"-bufsize", bufsize,
+		"-pix_fmt", "yuv420p",
+		"-c:a", "aac",
+		"-b:a", strconv.Itoa(TranscodeAudioBitrateKbps)+"k",
+		"-movflags", "+faststart",
+		"-y",
+		partFilePath,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to run ffmpeg: %w", err)
+	}
+
+	log.Printf("Running ffmpeg: %s", cmd.String())
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to run ffmpeg: %w", err)
+	}
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		// -progress writes key=value lines; out_time_us is the position reached so far
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		if key != "out_time_us" && key != "out_time_ms" { // out_time_ms is microseconds too
+			continue
+		}
+		if us, err := strconv.ParseInt(value, 10, 64); err == nil && us > 0 {
+			onProgress(min(float64(us)/1e6/duration, 1))
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		os.Remove(partFilePath)
+		return fmt.Errorf("ffmpeg transcoding failed (start %.3fs, duration %.3fs): %w\nStderr: %s",
+			startTime, duration, err, stderr.String())
+	}
+	return nil
+}
+
+// validTranscodePreset reports whether preset is a libx264 preset.
+func validTranscodePreset(preset string) bool {
+	for _, p := range transcodePresets {
+		if p == preset {
+			return true
+		}
+	}
+	return false
+}
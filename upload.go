@@ -0,0 +1,723 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/amarnathcjd/gogram/telegram"
+)
+
+// uploadOptions are per-upload settings shared by the CLI and daemon jobs.
+type uploadOptions struct {
+	// FileName overrides the name shown in Telegram (defaults to the file's base name).
+	FileName string `json:"file_name,omitempty"`
+	// Pipeline, if positive, uploads and deletes each part as soon as it is split,
+	// keeping at most this many parts on disk at once. Non-video files only use
+	// part files when CopyParts is set.
+	Pipeline int `json:"pipeline,omitempty"`
+	// CopyParts copies generic parts into temporary files instead of uploading
+	// byte ranges of the source directly.
+	CopyParts bool `json:"copy_parts,omitempty"`
+	// VideoSplit selects how video parts are cut: VideoSplitCut (default) or VideoSplitSegment.
+	VideoSplit string `json:"video_split,omitempty"`
+	// Transcode re-encodes videos that need splitting with libx264/AAC instead of cutting them.
+	Transcode bool `json:"transcode,omitempty"`
+	// TranscodeParts is the number of parts to transcode into (default 1).
+	TranscodeParts int `json:"transcode_parts,omitempty"`
+	// TranscodePreset is the libx264 preset (default DefaultTranscodePreset).
+	TranscodePreset string `json:"transcode_preset,omitempty"`
+	// Archive selects the format of generic parts: ArchiveNone (default) or ArchiveZip.
+	// Zip volumes are always written to temporary files, as with CopyParts.
+	Archive string `json:"archive,omitempty"`
+	// NoManifest skips sending the manifest document after the parts of a split upload.
+	NoManifest bool `json:"no_manifest,omitempty"`
+	// Parity is the number of Reed-Solomon parity parts sent after generic parts, as a
+	// count ("2") or a percentage of the data parts ("10%"). Empty sends none.
+	Parity string `json:"parity,omitempty"`
+	// Encrypt selects client-side encryption of everything sent: EncryptNone (default),
+	// EncryptPassphrase or EncryptRecipient. Encrypted files are split as generic parts,
+	// since encrypted video and audio parts cannot be played anyway.
+	Encrypt string `json:"encrypt,omitempty"`
+	// Recipient is the X25519 public key files are encrypted to with EncryptRecipient.
+	Recipient string `json:"recipient,omitempty"`
+	// Compress selects compression before splitting: CompressNone (default) or CompressZstd.
+	// Media and files whose samples do not compress are sent as they are.
+	Compress string `json:"compress,omitempty"`
+	// Parallel is the number of parts whose bytes are uploaded at the same time; the
+	// messages are still posted in part order. 0 or 1 uploads one part at a time.
+	// Pipelined and transcoded uploads always send one part at a time.
+	Parallel int `json:"parallel,omitempty"`
+	// NoCache uploads every part even if the media cache has a document with the same content.
+	NoCache bool `json:"no_cache,omitempty"`
+	// CopyTo lists further chats that get the sent documents, by reference, after the upload.
+	CopyTo []string `json:"copy_to,omitempty"`
+
+	// noPartDigests skips hashing parts whose checksum is not known anyway, for results
+	// that are only printed as message IDs. Split parts are still hashed for their state.
+	noPartDigests bool
+}
+
+// validate checks option values shared by the CLI flags and the job API.
+func (o uploadOptions) validate() error {
+	if o.Pipeline < 0 {
+		return fmt.Errorf("pipeline must not be negative, got %d", o.Pipeline)
+	}
+	if o.Parallel < 0 {
+		return fmt.Errorf("parallel must not be negative, got %d", o.Parallel)
+	}
+	switch o.VideoSplit {
+	case "", VideoSplitCut, VideoSplitSegment:
+	default:
+		return fmt.Errorf("unknown video split mode '%s': must be '%s' or '%s'", o.VideoSplit, VideoSplitCut, VideoSplitSegment)
+	}
+	if o.TranscodeParts < 0 {
+		return fmt.Errorf("transcode parts must not be negative, got %d", o.TranscodeParts)
+	}
+	if o.TranscodePreset != "" && !validTranscodePreset(o.TranscodePreset) {
+		return fmt.Errorf("unknown transcode preset '%s': must be one of %s", o.TranscodePreset, strings.Join(transcodePresets, ", "))
+	}
+	switch o.Archive {
+	case "", ArchiveNone, ArchiveZip:
+	default:
+		return fmt.Errorf("unknown archive format '%s': must be '%s' or '%s'", o.Archive, ArchiveNone, ArchiveZip)
+	}
+	if o.Parity != "" {
+		if _, err := parityCount(o.Parity, 1); err != nil {
+			return err
+		}
+	}
+	switch o.Encrypt {
+	case "", EncryptNone:
+		if o.Recipient != "" {
+			return fmt.Errorf("a recipient is only used with encryption mode '%s'", EncryptRecipient)
+		}
+	case EncryptPassphrase:
+		if os.Getenv(PassphraseEnv) == "" {
+			return fmt.Errorf("encryption mode '%s' needs the passphrase in %s", EncryptPassphrase, PassphraseEnv)
+		}
+	case EncryptRecipient:
+		if _, err := parseRecipient(o.Recipient); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown encryption mode '%s': must be '%s', '%s' or '%s'", o.Encrypt, EncryptNone, EncryptPassphrase, EncryptRecipient)
+	}
+	switch o.Compress {
+	case "", CompressNone, CompressZstd:
+	default:
+		return fmt.Errorf("unknown compression '%s': must be '%s' or '%s'", o.Compress, CompressNone, CompressZstd)
+	}
+	if o.encrypted() && o.Transcode {
+		return fmt.Errorf("transcoding cannot be combined with encryption")
+	}
+	if o.encrypted() && o.Archive == ArchiveZip {
+		return fmt.Errorf("zip volumes cannot be combined with encryption")
+	}
+	return nil
+}
+
+// encrypted reports whether everything sent is encrypted first.
+func (o uploadOptions) encrypted() bool {
+	return o.Encrypt != "" && o.Encrypt != EncryptNone
+}
+
+// rangeUpload reports whether generic parts are uploaded as byte ranges of the source
+// rather than written to part files first.
+func (o uploadOptions) rangeUpload() bool {
+	return !o.CopyParts && o.Archive != ArchiveZip
+}
+
+// runUpload sends filePath to chatID, splitting it first when it exceeds MaxFileSize,
+// and then delivers the sent documents to each chat in opts.CopyTo without uploading
+// them again. It never exits the process; failures are recorded in the returned result.
+// Cancelling ctx stops the upload before the next split or send step.
+//
+// If store is non-nil, split progress is saved after every part so that a later
+// call with the same store skips parts that were already sent. Parts are kept
+// on disk until the upload succeeds.
+//
+// If cache is non-nil, the file and parts whose content was sent before are sent
+// by reference to the cached document instead of being uploaded again, and newly
+// uploaded ones are added to it. Encrypted uploads are never cached.
+func runUpload(ctx context.Context, client *telegram.Client, chatID, filePath string, opts uploadOptions, events *eventStream, store stateStore, cache *mediaCache, bots *botPool) *uploadResult {
+	result := uploadFile(ctx, client, chatID, filePath, opts, events, store, cache, bots)
+	if len(opts.CopyTo) > 0 {
+		deliverCopies(ctx, client, result, opts.CopyTo, events)
+	}
+	events.emit(EventResult, event{Result: result, Error: result.Error})
+	return result
+}
+
+// uploadFile sends filePath to chatID; see runUpload.
+func uploadFile(ctx context.Context, client *telegram.Client, chatID, filePath string, opts uploadOptions, events *eventStream, store stateStore, cache *mediaCache, bots *botPool) *uploadResult {
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		result := newUploadResult(chatID, opts.FileName, 0)
+		return failUpload(result, fmt.Errorf("error getting file metadata for %s: %w", filePath, err))
+	}
+	originalFileName := fileInfo.Name()
+	if opts.FileName != "" {
+		originalFileName = opts.FileName
+	}
+	fileSize := fileInfo.Size()
+	result := newUploadResult(chatID, originalFileName, fileSize)
+	result.hashParts = !opts.noPartDigests
+
+	// --- Detect File Type ---
+	media, err := classifyMedia(filePath)
+	if err != nil {
+		log.Printf("Warning: Could not detect MIME type for %s: %v. Proceeding with generic splitting.", originalFileName, err)
+		media = &mediaInfo{MimeType: "application/octet-stream", DetectedBy: DetectedBySniff} // Default fallback
+	}
+	log.Printf("Detected MIME type: %s (by %s)", media.MimeType, media.DetectedBy)
+	if media.Container != "" {
+		log.Printf("Container: %s, video: %t (%s), audio: %t (%s), subtitles: %t",
+			media.Container, media.HasVideo, media.VideoCodec, media.HasAudio, media.AudioCodec, media.HasSubtitles)
+	}
+	result.MimeType = media.MimeType
+	result.Media = media
+	events.emit(EventMimeDetected, event{File: originalFileName, MimeType: media.MimeType, Total: fileSize, Media: media})
+	isVideo := media.isVideo()
+	isAudio := media.isAudio()
+	var tags audioTags
+	if isAudio {
+		tags = probeAudioTags(filePath)
+	}
+
+	sl, err := newSealer(opts)
+	if err != nil {
+		return failUpload(result, fmt.Errorf("error setting up encryption: %w", err))
+	}
+	if sl != nil {
+		log.Printf("Encrypting '%s' (%s, key from %s).", originalFileName, EncryptionScheme, opts.Encrypt)
+		result.Encryption = &sl.info
+		result.sealer = sl
+		if isVideo || isAudio {
+			log.Printf("Encrypted parts cannot be played; splitting '%s' into generic parts.", originalFileName)
+			isVideo, isAudio = false, false
+		}
+	}
+
+	compressedPath, compression, err := compressForUpload(ctx, filePath, originalFileName, media, opts, store != nil, events)
+	if err != nil {
+		return failUpload(result, fmt.Errorf("error compressing '%s': %w", originalFileName, err))
+	}
+	if compressedPath != "" {
+		// The compressed copy is split and sent in place of the file; it is kept for a resume like parts are
+		defer func() {
+			if store != nil && !result.Success {
+				log.Printf("Keeping compressed copy %s for resume.", compressedPath)
+				return
+			}
+			if err := os.Remove(compressedPath); err != nil && !os.IsNotExist(err) {
+				log.Printf("Warning: Failed to remove compressed copy %s: %v", compressedPath, err)
+			}
+		}()
+		if fileInfo, err = os.Stat(compressedPath); err != nil {
+			return failUpload(result, fmt.Errorf("error getting file metadata for %s: %w", compressedPath, err))
+		}
+		filePath = compressedPath
+		fileSize = fileInfo.Size()
+		originalFileName += CompressedSuffix
+		result.FileName = originalFileName
+		result.FileSize = fileSize
+		result.Compression = compression
+	}
+	if opts.NoCache || sl != nil {
+		cache = nil
+	}
+
+	// --- File Handling Logic ---
+	if fileSize <= MaxFileSize {
+		log.Printf("File '%s' is small enough, sending directly.", originalFileName)
+		var part partResult
+		var sum string
+		var cacheKey []byte
+		if cache != nil {
+			var err error
+			if sum, err = fileSHA256(filePath); err == nil {
+				cacheKey = mediaCacheKey(sum, fileSize, originalFileName)
+			} else {
+				log.Printf("Warning: Could not hash '%s' for the media cache: %v", originalFileName, err)
+			}
+		}
+		if cached, ok := cache.sendCached(client, chatID, cacheKey, 1, events); ok {
+			part = cached
+		} else if sl != nil {
+			part = sendSealed(client, chatID, sl, filePath, 0, fileSize, originalFileName+EncryptedSuffix, 1, events, 0)
+		} else if isAudio {
+			part = sendAudio(client, chatID, filePath, originalFileName, 1, tags.attribute(media.DurationS, ""), events, 0)
+		} else {
+			part = sendFile(client, chatID, filePath, originalFileName, 1, events, 0)
+		}
+		part.SHA256 = sum // Saves addPart hashing the file again
+		if cacheKey != nil && !part.Cached {
+			cache.put(cacheKey, part, chatID)
+		}
+		if isVideo || isAudio {
+			part.DurationS = media.DurationS
+			if part.DurationS == 0 {
+				part.DurationS, _ = getVideoDuration(filePath)
+			}
+		}
+		result.addPart(part, filePath)
+		if part.Error != "" {
+			return failUpload(result, fmt.Errorf("failed to send file '%s' to chat '%s': %s", filePath, chatID, part.Error))
+		}
+		return finishUpload(result, nil)
+	}
+
+	log.Printf("File '%s' is larger than MaxFileSize (%d bytes). Splitting...", originalFileName, MaxFileSize)
+	result.Split = true
+
+	sender := &partSender{
+		ctx:     ctx,
+		opts:    opts,
+		client:  client,
+		chatID:  chatID,
+		name:    originalFileName,
+		isVideo: isVideo,
+		isAudio: isAudio,
+		tags:    tags,
+		sealer:  sl,
+		cache:   cache,
+		bots:    bots,
+		events:  events,
+		store:   store,
+		result:  result,
+	}
+	previous := loadResumeState(store, chatID, filePath, fileInfo)
+	if previous != nil && previous.Encrypt != sl.mode() {
+		log.Printf("Saved upload state for %s was sent with different encryption. Starting from scratch.", filePath)
+		previous = nil
+	}
+
+	if isVideo && opts.Transcode {
+		return sender.sendTranscoded(filePath, fileInfo, previous)
+	}
+	// A media file that fell back to byte ranges in an earlier run resumes as ranges too
+	if (!isVideo && !isAudio && opts.rangeUpload()) || (previous != nil && previous.Strategy == StrategyRange && previous.SplitDone) {
+		return sender.sendRanges(filePath, fileInfo, previous)
+	}
+	if opts.Pipeline > 0 {
+		return sender.sendPipelined(filePath, fileInfo, previous, opts.Pipeline)
+	}
+
+	var partPaths []string
+	var parts []splitPart
+	var splitErr error
+	state := previous
+	resumed := false
+
+	if previous != nil && previous.SplitDone {
+		if err := previous.restoreMissingParts(ctx); err != nil {
+			log.Printf("Warning: Could not restore missing parts of '%s': %v. Splitting again.", originalFileName, err)
+		} else {
+			resumed = true
+			partPaths = previous.partPaths()
+			saveState(store, previous)
+			log.Printf("Resuming '%s' from saved state: %d of %d parts already sent.", originalFileName, previous.sentCount(), len(partPaths))
+		}
+	}
+
+	if !resumed {
+		if isVideo || isAudio {
+			log.Println("File identified as video or audio. Splitting into playable parts using ffmpeg...")
+			parts, splitErr = sender.splitMedia(ctx, filePath, nil)
+			if errors.Is(splitErr, errNoMediaSplit) {
+				log.Printf("Warning: Could not split '%s' into playable parts: %v. Splitting into generic parts.", originalFileName, splitErr)
+				sender.fallBackToGeneric(fileSize)
+				if opts.rangeUpload() {
+					return sender.sendRanges(filePath, fileInfo, previous)
+				}
+				parts, splitErr = sender.splitGeneric(ctx, filePath, nil)
+			}
+			if splitErr != nil {
+				return failUpload(result, fmt.Errorf("error splitting media file '%s': %w", filePath, splitErr))
+			}
+			log.Printf("File split into %d parts.", len(parts))
+		} else {
+			log.Println("File is not a video or detection failed. Splitting into generic parts...")
+			parts, splitErr = sender.splitGeneric(ctx, filePath, nil)
+			if splitErr != nil {
+				return failUpload(result, fmt.Errorf("error splitting generic file '%s': %w", filePath, splitErr))
+			}
+			log.Printf("File split into %d parts.", len(parts))
+		}
+		partPaths = splitPaths(parts)
+
+		state = sender.newState(filePath, fileInfo, previous)
+		if err := state.setParts(parts, previous); err != nil {
+			cleanupParts(partPaths)
+			return failUpload(result, err)
+		}
+		saveState(store, state)
+	}
+	sender.state = state
+	sender.total = len(partPaths)
+
+	// Parts are temporary, but kept for a later resume if the upload does not complete
+	defer func() {
+		if store != nil && !result.Success {
+			log.Printf("Keeping %d parts of '%s' on disk for resume.", len(partPaths), originalFileName)
+			return
+		}
+		cleanupParts(partPaths)
+		if store != nil {
+			if err := store.clearState(); err != nil {
+				log.Printf("Warning: Failed to clear upload state for %s: %v", filePath, err)
+			}
+		}
+	}()
+
+	// --- Send Parts ---
+	statusText := fmt.Sprintf("Sending '%s' in %d parts...", originalFileName, len(partPaths))
+	if previous != nil {
+		statusText = fmt.Sprintf("Resuming '%s' in %d parts (%d already sent)...", originalFileName, len(partPaths), state.sentCount())
+	}
+	initialMsg := sender.postStatus(statusText)
+	sender.sendParts(partPaths)
+
+	return sender.finish(initialMsg, nil)
+}
+
+// partSender sends the parts of one split upload in order, recording each part
+// in the result and in the saved upload state.
+type partSender struct {
+	ctx     context.Context
+	opts    uploadOptions
+	client  *telegram.Client
+	chatID  string
+	name    string // Display name of the original file
+	isVideo bool
+	isAudio bool
+	tags    audioTags // Title and performer of audio files
+	sealer  *sealer   // Encrypts every document sent, nil if not encrypted
+	cache   *mediaCache
+	bots    *botPool // Spreads parts over several bots, nil to send them all with client
+	events  *eventStream
+	store   stateStore
+	state   *uploadState
+	result  *uploadResult
+	total   int // Number of parts, or 0 while still unknown
+	failed  bool
+}
+
+// newState creates the upload state for a fresh split, keeping the status message of previous.
+func (s *partSender) newState(filePath string, fileInfo os.FileInfo, previous *uploadState) *uploadState {
+	strategy := StrategyGeneric
+	switch {
+	case s.isVideo:
+		strategy = StrategyVideo
+	case s.isAudio:
+		strategy = StrategyAudio
+	}
+	if strategy == StrategyGeneric && s.opts.Archive == ArchiveZip {
+		strategy = StrategyArchive
+	}
+	state := newUploadState(s.chatID, filePath, fileInfo, strategy)
+	state.Encrypt = s.sealer.mode()
+	if strategy == StrategyGeneric {
+		state.PartSize = PartSize
+	}
+	if previous != nil {
+		state.StatusMsgID = previous.StatusMsgID
+	}
+	return state
+}
+
+// partName returns the file name shown in Telegram for a part.
+func (s *partSender) partName(partNum int) string {
+	if s.state.Strategy == StrategyArchive {
+		return zipVolumeName(s.name, partNum) // Archivers find the volumes by name
+	}
+	name := s.documentName()
+	if s.total == 1 {
+		return name // A single re-encoded part
+	}
+	if s.total > 0 {
+		return fmt.Sprintf("%s (Part %d/%d)", name, partNum, s.total)
+	}
+	return fmt.Sprintf("%s (Part %d)", name, partNum)
+}
+
+// documentName returns the name that the documents of the upload are named after:
+// the file's name, with EncryptedSuffix if they are encrypted.
+func (s *partSender) documentName() string {
+	if s.sealer != nil {
+		return s.name + EncryptedSuffix
+	}
+	return s.name
+}
+
+// send uploads part i (0-based) unless the saved state shows it was already sent.
+func (s *partSender) send(i int, partPath string) {
+	s.sendPart(i, partPath, nil)
+}
+
+// sendPart sends part i (0-based) like send, posting up instead of uploading the part
+// if its bytes were uploaded ahead by sendParts.
+func (s *partSender) sendPart(i int, partPath string, up *uploadedPart) {
+	partNum := i + 1
+	partFileName := s.partName(partNum)
+	saved := &s.state.Parts[i]
+
+	if saved.MessageID != 0 {
+		log.Printf("Part %d already sent as message %d, skipping.", partNum, saved.MessageID)
+		s.result.Parts = append(s.result.Parts, partResult{
+			Index:     partNum,
+			MessageID: saved.MessageID,
+			FileName:  partFileName,
+			Size:      saved.Size,
+			SHA256:    saved.SHA256,
+			DurationS: saved.DurationS,
+			Resumed:   true,
+		})
+		return
+	}
+	if partPath != "" {
+		log.Printf("Sending part %d: %s", partNum, partPath)
+	} else {
+		log.Printf("Sending part %d: %d bytes at offset %d", partNum, saved.Size, int64(i)*s.state.PartSize)
+	}
+
+	// Send the current part
+	var part partResult
+	if up != nil && saved.SHA256 == "" {
+		saved.SHA256 = up.sha256
+	}
+	if s.state.Strategy == StrategyRange && saved.SHA256 == "" && s.hashRanges() {
+		if sum, err := rangeSHA256(s.state.Source, int64(i)*s.state.PartSize, saved.Size); err == nil {
+			saved.SHA256 = sum
+		} else {
+			log.Printf("Warning: Could not hash part %d of %s: %v", partNum, s.state.Source, err)
+		}
+	}
+	var cacheKey []byte
+	if s.cache != nil && saved.SHA256 != "" {
+		cacheKey = mediaCacheKey(saved.SHA256, saved.Size, partFileName)
+	}
+	cached, fromCache := s.cache.sendCached(s.client, s.chatID, cacheKey, partNum, s.events)
+	if fromCache {
+		part = cached
+	} else {
+		part = s.sendWithBots(i, partPath, up)
+	}
+	part.DurationS = saved.DurationS
+	part.SHA256 = saved.SHA256
+	if cacheKey != nil && !fromCache {
+		s.cache.put(cacheKey, part, s.chatID)
+	}
+	s.result.addPart(part, partPath)
+	if part.Error == "" {
+		log.Printf("Sent part %d, message ID: %v", partNum, part.MessageID)
+		saved.MessageID = part.MessageID
+		saveState(s.store, s.state)
+	} else {
+		log.Printf("Failed to send part '%s' (part %d) to chat '%s'", partFileName, partNum, s.chatID)
+		s.failed = true
+		// break // Uncomment to stop after first failure
+	}
+}
+
+// hashRanges reports whether range parts are hashed before they are sent, which reads
+// each of them twice. Only the media cache key, the result, the manifest and the checks
+// of parts rebuilt from parity use the checksum.
+func (s *partSender) hashRanges() bool {
+	return s.cache != nil || s.result.hashParts || !s.opts.NoManifest || s.opts.Parity != ""
+}
+
+// sendWithBots sends part i with the next bot of the pool, or with the upload's client
+// if there is no pool, and hands it to another bot if that one is in a long flood wait.
+func (s *partSender) sendWithBots(i int, partPath string, up *uploadedPart) partResult {
+	var bot *botClient
+	if up != nil && up.media != nil {
+		bot = up.bot // Uploaded files can only be sent by the bot that uploaded them
+	} else {
+		bot = s.bots.acquire(s.events)
+	}
+	for attempt := 1; ; attempt++ {
+		client := s.client
+		if bot != nil {
+			client = bot.client
+		}
+		part := s.sendWith(client, i, partPath, up, s.bots.maxWait())
+		if bot == nil {
+			return part
+		}
+		part.Bot = bot.name
+		if bot.client != s.client {
+			s.primaryDocument(&part)
+		}
+		if !bot.report(part.Size, part.Error) || attempt >= s.bots.size() {
+			return part
+		}
+		log.Printf("Sending part %d again with another bot.", i+1)
+		up = nil
+		bot = s.bots.acquire(s.events)
+	}
+}
+
+// primaryDocument replaces the document of a part another bot of the pool sent, whose
+// access hash is only good for that bot, with the same document as the upload's client
+// sees it, for the media cache and copies to other chats.
+func (s *partSender) primaryDocument(part *partResult) {
+	part.document = nil
+	if part.Error != "" || (s.cache == nil && len(s.opts.CopyTo) == 0) {
+		return
+	}
+	doc, err := lookupDocument(s.client, s.chatID, part.MessageID)
+	if err != nil {
+		log.Printf("Warning: Could not look up part %d as sent by %s: %v", part.Index, part.Bot, err)
+		return
+	}
+	part.document = doc
+}
+
+// sendWith uploads and posts part i with client, or only posts up if it was uploaded ahead.
+// Flood waits longer than maxWait fail the part, if maxWait is set.
+func (s *partSender) sendWith(client *telegram.Client, i int, partPath string, up *uploadedPart, maxWait time.Duration) partResult {
+	partNum := i + 1
+	partFileName := s.partName(partNum)
+	saved := s.state.Parts[i]
+	offset := int64(i) * s.state.PartSize
+	switch {
+	case up != nil && up.media != nil:
+		return sendUploaded(client, s.chatID, up.media, partFileName, saved.Size, partNum, s.events, maxWait)
+	case s.sealer != nil && s.state.Strategy == StrategyRange:
+		return sendSealed(client, s.chatID, s.sealer, s.state.Source, offset, saved.Size, partFileName, partNum, s.events, maxWait)
+	case s.sealer != nil:
+		return sendSealed(client, s.chatID, s.sealer, partPath, 0, saved.Size, partFileName, partNum, s.events, maxWait)
+	case s.state.Strategy == StrategyRange:
+		return sendRange(client, s.chatID, s.state.Source, offset, saved.Size, partFileName, partNum, s.events, maxWait)
+	case s.state.Strategy == StrategyAudio:
+		attribute := s.tags.attribute(saved.DurationS, fmt.Sprintf(" (Part %d/%d)", partNum, s.total))
+		return sendAudio(client, s.chatID, partPath, partFileName, partNum, attribute, s.events, maxWait)
+	default:
+		return sendFile(client, s.chatID, partPath, partFileName, partNum, s.events, maxWait)
+	}
+}
+
+// postStatus posts (or, when resuming, edits) the "Sending ..." status message and saves its ID.
+// The split method and any failed methods before it are added below text.
+func (s *partSender) postStatus(text string) *telegram.NewMessage {
+	text += s.statusNote()
+	msg := postStatus(s.client, s.chatID, s.state.StatusMsgID, text)
+	if msg != nil && msg.ID != s.state.StatusMsgID {
+		s.state.StatusMsgID = msg.ID
+		saveState(s.store, s.state)
+	}
+	return msg
+}
+
+// statusNote returns the lines added below the status message: the split method, the
+// compression codec and, for zip volumes or encrypted parts, how to get the file back.
+func (s *partSender) statusNote() string {
+	var note string
+	if c := s.result.Compression; c != nil {
+		note += fmt.Sprintf("\nCompressed with %s: %.2f MB to %.2f MB.", c.Codec, float64(c.OriginalSize)/1024/1024, float64(c.Size)/1024/1024)
+	}
+	if s.sealer != nil {
+		note += fmt.Sprintf("\nEncrypted (%s); the download command decrypts and joins the parts.", s.sealer.info.KeyWrap)
+	}
+	if split := s.splitNote(); split != "" {
+		note += "\n" + split
+	}
+	if s.state != nil && s.state.Strategy == StrategyArchive {
+		note += "\n" + zipInstructions(s.name)
+	}
+	return note
+}
+
+// finish edits the status message with the outcome and finalizes the result.
+// err is a failure that stopped the upload early, such as a split error.
+func (s *partSender) finish(statusMsg *telegram.NewMessage, err error) *uploadResult {
+	// --- Final Status ---
+	var finalStatusMsg string
+	sent := len(s.result.messageIDs())
+
+	if err == nil && s.ctx.Err() == nil && !s.failed && s.opts.Parity != "" {
+		if parityErr := s.sendParity(); parityErr != nil {
+			err = fmt.Errorf("parity parts: %w", parityErr)
+		}
+	}
+
+	switch {
+	case s.ctx.Err() != nil:
+		finalStatusMsg = fmt.Sprintf("Cancelled sending '%s'. %d of %d parts sent.", s.name, sent, len(s.state.Parts))
+		err = s.ctx.Err()
+	case err != nil:
+		finalStatusMsg = fmt.Sprintf("Failed sending '%s' after %d parts: %v", s.name, sent, err)
+	case s.failed:
+		finalStatusMsg = fmt.Sprintf("Finished sending '%s'. %d parts sent, but some failed.", s.name, sent)
+	default:
+		finalStatusMsg = fmt.Sprintf("Finished sending '%s' in %d parts.", s.name, len(s.state.Parts))
+		if s.result.Parity != nil {
+			finalStatusMsg += fmt.Sprintf("\n%d parity parts can rebuild up to %d lost parts.", len(s.result.Parity.Parts), len(s.result.Parity.Parts))
+		}
+		if !s.opts.NoManifest {
+			if manifestErr := s.sendManifest(); manifestErr != nil {
+				log.Printf("Warning: %v", manifestErr)
+				finalStatusMsg += fmt.Sprintf("\nThe manifest could not be sent: %v", manifestErr)
+			} else {
+				if s.sealer == nil { // The checksum would identify the encrypted file
+					finalStatusMsg += fmt.Sprintf("\nSHA-256: %s", s.result.SHA256)
+				}
+				finalStatusMsg += "\nManifest: " + manifestName(s.name, s.sealer)
+			}
+		}
+	}
+
+	finalStatusMsg += s.statusNote()
+
+	if statusMsg != nil {
+		_, editErr := statusMsg.Edit(finalStatusMsg)
+		if editErr != nil {
+			log.Printf("Warning: Failed to edit final status message: %v", editErr)
+			s.client.SendMessage(s.chatID, finalStatusMsg)
+		}
+	} else {
+		s.client.SendMessage(s.chatID, finalStatusMsg)
+	}
+
+	s.result.Strategy = s.state.Strategy
+	if err != nil {
+		return failUpload(s.result, err)
+	}
+	return finishUpload(s.result, nil)
+}
+
+// postStatus edits the status message msgID left by an interrupted run, or sends a new one
+// if there is none or it can no longer be edited.
+func postStatus(client *telegram.Client, chatID string, msgID int32, text string) *telegram.NewMessage {
+	if msgID != 0 {
+		msg, err := client.EditMessage(chatID, msgID, text)
+		if err == nil && msg != nil {
+			return msg
+		}
+		log.Printf("Warning: Could not edit previous status message %d: %v. Sending a new one.", msgID, err)
+	}
+	msg, err := client.SendMessage(chatID, text)
+	if err != nil {
+		log.Printf("Warning: Could not send status message: %v", err)
+	}
+	return msg
+}
+
+// finishUpload finalizes the result. runUpload emits it as the last event once
+// copies have been delivered.
+func finishUpload(result *uploadResult, err error) *uploadResult {
+	result.finish(err)
+	return result
+}
+
+// failUpload logs err and finalizes the result as failed.
+func failUpload(result *uploadResult, err error) *uploadResult {
+	log.Printf("Error: %v", err)
+	return finishUpload(result, err)
+}